@@ -0,0 +1,367 @@
+// alert.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// alert is what we tell people about a newly found certificate
+type alert struct {
+	ID        int64     `json:"id"`
+	Domain    string    `json:"domain"`
+	Names     []string  `json:"names"`
+	Owner     string    `json:"owner"`
+	Issuer    string    `json:"issuer"`
+	SHA256    string    `json:"sha256"`
+	Serial    string    `json:"serial"`
+	CTServer  string    `json:"server"`
+	LogURL    string    `json:"log_url"`
+	LogIndex  int64     `json:"log_index"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Precert   bool      `json:"precert"`
+	Valid     bool      `json:"valid"`
+	Reason    string    `json:"reason"`
+	Score     float64   `json:"score"`
+	Verdict   string    `json:"verdict"`
+	Cert      string    `json:"cert"`
+}
+
+func newAlert(r *record, owner string) alert {
+	a := alert{
+		Domain:    r.Domain,
+		Names:     r.Names,
+		Owner:     owner,
+		Issuer:    r.Issuer,
+		SHA256:    r.SHA256,
+		Serial:    r.Serial,
+		CTServer:  r.CTServer,
+		NotBefore: r.NotBefore,
+		NotAfter:  r.NotAfter,
+		Precert:   r.Precert,
+		Valid:     r.Valid,
+		Reason:    r.Reason,
+		Score:     r.Score,
+		Verdict:   r.Verdict,
+		Cert:      r.Cert,
+	}
+	if len(r.Sightings) > 0 {
+		a.LogURL = r.Sightings[0].LogURL
+		a.LogIndex = r.Sightings[0].LogIndex
+	}
+	return a
+}
+
+// notifier is somewhere alerts are delivered to
+type notifier interface {
+	// Name identifies the notifier's entries in the outbox
+	Name() string
+	// Wants reports whether the alert should be sent to this notifier
+	Wants(a *alert) bool
+	// Deliver sends a batch of alerts, either all of them or none
+	Deliver(alerts []alert) error
+	// MaxBatch is the most alerts Deliver takes at once
+	MaxBatch() int
+}
+
+// splitter is a notifier that sends a batch of alerts as several messages.
+// The alerter delivers and records each message on its own, so a failure
+// part way through a batch doesn't send the messages before it again.
+type splitter interface {
+	// Split groups alerts into the messages they are sent in
+	Split(alerts []alert) [][]alert
+}
+
+// scheduler is a notifier that holds some alerts back, e.g. for a digest
+type scheduler interface {
+	// Due returns when an alert queued at now should be delivered
+	Due(a *alert, now time.Time) time.Time
+}
+
+// alertRoute picks the alerts a notifier gets: those for any of its owners or
+// for a name covered by any of its domains, or every alert if it has neither
+type alertRoute struct {
+	Owners  []string `json:"owners"`
+	Domains []string `json:"domains"`
+	index   *domainIndex
+}
+
+func (r *alertRoute) wants(a *alert) bool {
+	if len(r.Owners) == 0 && len(r.Domains) == 0 {
+		return true
+	}
+	if a.Owner != "" && containsFold(r.Owners, a.Owner) {
+		return true
+	}
+	for _, name := range append([]string{a.Domain}, a.Names...) {
+		if _, ok := r.index.lookup(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookConfig is a URL alerts are POSTed to as JSON. If it has a secret,
+// each request carries the hex HMAC-SHA256 of its body in the
+// X-Monitor-Signature header.
+type webhookConfig struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	alertRoute
+}
+
+type webhookNotifier struct {
+	webhookConfig
+	client *http.Client
+}
+
+func (n *webhookNotifier) Name() string {
+	return "webhook:" + n.webhookConfig.Name
+}
+
+// Wants leaves out expected certificates, which only email digests list
+func (n *webhookNotifier) Wants(a *alert) bool {
+	return a.Verdict != verdictExpected && n.wants(a)
+}
+
+func (n *webhookNotifier) MaxBatch() int {
+	return 1
+}
+
+func (n *webhookNotifier) Deliver(alerts []alert) error {
+	for _, a := range alerts {
+		body, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Monitor-Delivery", strconv.FormatInt(a.ID, 10))
+		if n.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(n.Secret))
+			mac.Write(body)
+			req.Header.Set("X-Monitor-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook %s returned %s", n.webhookConfig.Name, resp.Status)
+		}
+	}
+	return nil
+}
+
+// alertConfig is the file given by -alerts
+type alertConfig struct {
+	Webhooks []webhookConfig `json:"webhooks"`
+	Emails   []emailConfig   `json:"emails"`
+	Chats    []chatConfig    `json:"chats"`
+}
+
+// alerter queues alerts for each notifier that wants them in an outbox in the
+// database, and delivers them from there, retrying with backoff, so that none
+// are lost to a failing endpoint or a restart
+type alerter struct {
+	db          *sql.DB
+	notifiers   map[string]notifier
+	poll        time.Duration
+	maxAttempts int
+}
+
+var alerts *alerter
+
+// Delay before the first retry of a failed delivery, doubling each time up
+// to maxRetryDelay
+const (
+	minRetryDelay = 30 * time.Second
+	maxRetryDelay = time.Hour
+)
+
+// newAlerter sets up the notifiers listed in an alert configuration file
+func newAlerter(db *sql.DB, filename string) (*alerter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var conf alertConfig
+	if err := json.NewDecoder(f).Decode(&conf); err != nil {
+		return nil, err
+	}
+
+	al := &alerter{
+		db:          db,
+		notifiers:   make(map[string]notifier),
+		poll:        10 * time.Second,
+		maxAttempts: 12,
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, webhook := range conf.Webhooks {
+		webhook.index = newDomainIndex(webhook.Domains)
+		al.add(&webhookNotifier{webhook, client})
+	}
+	for _, email := range conf.Emails {
+		email.index = newDomainIndex(email.Domains)
+		n, err := newEmailNotifier(email)
+		if err != nil {
+			return nil, err
+		}
+		al.add(n)
+	}
+	for _, chat := range conf.Chats {
+		chat.index = newDomainIndex(chat.Domains)
+		n, err := newChatNotifier(chat, client)
+		if err != nil {
+			return nil, err
+		}
+		al.add(n)
+	}
+	return al, nil
+}
+
+func (al *alerter) add(n notifier) {
+	al.notifiers[n.Name()] = n
+}
+
+// dispatch queues an alert for every notifier that wants it, in the
+// transaction storing the certificate it is about
+func (al *alerter) dispatch(tx *sql.Tx, a alert) error {
+	if al == nil {
+		return nil
+	}
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for name, n := range al.notifiers {
+		if !n.Wants(&a) {
+			continue
+		}
+		due := now
+		if s, ok := n.(scheduler); ok {
+			due = s.Due(&a, now)
+		}
+		if err := enqueueAlert(tx, name, payload, due); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run delivers queued alerts as they come due, until ctx is cancelled
+func (al *alerter) run(ctx context.Context) {
+	for {
+		for name, n := range al.notifiers {
+			al.deliver(name, n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(al.poll):
+		}
+	}
+}
+
+// deliver sends a notifier every alert that is due, a batch at a time
+func (al *alerter) deliver(name string, n notifier) {
+	for {
+		due, err := dueAlerts(al.db, name, n.MaxBatch())
+		if err != nil {
+			log.Noticef("Couldn't read outbox for %s: %s", name, err)
+			return
+		}
+		if len(due) == 0 {
+			return
+		}
+
+		attempts := make(map[int64]int, len(due))
+		batch := make([]alert, 0, len(due))
+		for _, entry := range due {
+			var a alert
+			if err := json.Unmarshal(entry.Payload, &a); err != nil {
+				log.Errorf("Dropping unreadable alert %d for %s: %s", entry.ID, name, err)
+				failAlerts(al.db, []int64{entry.ID}, err, time.Time{})
+				continue
+			}
+			a.ID = entry.ID
+			attempts[a.ID] = entry.Attempts
+			batch = append(batch, a)
+		}
+
+		messages := [][]alert{batch}
+		if s, ok := n.(splitter); ok {
+			messages = s.Split(batch)
+		}
+		for i, message := range messages {
+			if len(message) == 0 {
+				continue
+			}
+			ids := alertIDs(message)
+			if err := n.Deliver(message); err != nil {
+				tries := attempts[ids[0]] + 1
+				retry := time.Time{}
+				if tries < al.maxAttempts {
+					retry = time.Now().Add(retryDelay(tries))
+				}
+				log.Noticef("Couldn't deliver %d alerts to %s (attempt %d): %s", len(ids), name, tries, err)
+				if err := failAlerts(al.db, ids, err, retry); err != nil {
+					log.Errorf("Couldn't update outbox for %s: %s", name, err)
+				}
+				// The messages not tried yet wait as long, without it
+				// counting as an attempt
+				var rest []int64
+				for _, m := range messages[i+1:] {
+					rest = append(rest, alertIDs(m)...)
+				}
+				if err := postponeAlerts(al.db, rest, retry); err != nil {
+					log.Errorf("Couldn't update outbox for %s: %s", name, err)
+				}
+				return
+			}
+			if err := deliveredAlerts(al.db, ids); err != nil {
+				log.Errorf("Couldn't update outbox for %s: %s", name, err)
+				return
+			}
+		}
+	}
+}
+
+func alertIDs(alerts []alert) []int64 {
+	ids := make([]int64, len(alerts))
+	for i, a := range alerts {
+		ids[i] = a.ID
+	}
+	return ids
+}
+
+func retryDelay(attempts int) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
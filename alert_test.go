@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertRoute(t *testing.T) {
+	route := alertRoute{Owners: []string{"web"}, Domains: []string{"*.imsg.com"}}
+	route.index = newDomainIndex(route.Domains)
+	cases := []struct {
+		a     alert
+		wants bool
+	}{
+		{alert{Domain: "mbernhard.com", Owner: "Web"}, true},
+		{alert{Domain: "mbernhard.com", Owner: "mail"}, false},
+		{alert{Domain: "x.com", Names: []string{"x.com", "www.imsg.com"}}, true},
+		{alert{Domain: "a.b.imsg.com"}, false},
+	}
+	for _, c := range cases {
+		if route.wants(&c.a) != c.wants {
+			t.Errorf("%v: expected wants %v", c.a, c.wants)
+		}
+	}
+
+	var all alertRoute
+	if !all.wants(&alert{Domain: "anything.com"}) {
+		t.Errorf("Expected a route with no owners or domains to want every alert")
+	}
+}
+
+func TestExpectedAlerts(t *testing.T) {
+	expected := &alert{Domain: "mbernhard.com", Verdict: verdictExpected}
+	violation := &alert{Domain: "mbernhard.com", Verdict: verdictViolation}
+	for _, n := range []notifier{&webhookNotifier{}, &chatNotifier{}} {
+		if n.Wants(expected) || !n.Wants(violation) {
+			t.Errorf("%T: expected only violations to be sent", n)
+		}
+	}
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	var got alert
+	var signature string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &got)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if r.Header.Get("X-Monitor-Signature") != signature {
+			t.Errorf("Expected signature %s, got %s", signature, r.Header.Get("X-Monitor-Signature"))
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	n := &webhookNotifier{webhookConfig{Name: "test", URL: server.URL, Secret: "secret"}, server.Client()}
+	if err := n.Deliver([]alert{{ID: 7, Domain: "mbernhard.com"}}); err != nil {
+		t.Errorf("Unexpected error delivering: %s", err)
+	}
+	if got.ID != 7 || got.Domain != "mbernhard.com" {
+		t.Errorf("Expected alert 7 for mbernhard.com, got %d for %s", got.ID, got.Domain)
+	}
+
+	status = http.StatusBadGateway
+	if err := n.Deliver([]alert{{ID: 8, Domain: "mbernhard.com"}}); err == nil {
+		t.Errorf("Expected an error from a %d response", status)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		4:  4 * time.Minute,
+		20: time.Hour,
+	}
+	for attempts, delay := range cases {
+		if retryDelay(attempts) != delay {
+			t.Errorf("Attempt %d: expected %s, got %s", attempts, delay, retryDelay(attempts))
+		}
+	}
+}
+
+// Needs the test database: alerts are stored with their certificate or not
+// at all
+func TestDispatchWithCertificate(t *testing.T) {
+	db, err := openDatabase(os.Getenv("TEST_DB_USERNAME"), os.Getenv("TEST_DB_PASSWORD"), os.Getenv("TEST_DB_NAME"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	clear := func() {
+		db.Exec("DELETE FROM certificates WHERE issuer = 'CN=Dispatch CA'")
+		db.Exec("DELETE FROM alert_outbox WHERE notifier = 'dispatch'")
+	}
+	clear()
+	defer clear()
+
+	al := &alerter{db: db, notifiers: make(map[string]notifier)}
+	al.add(&webhookNotifier{webhookConfig{Name: "dispatch"}, nil})
+	count := func() (certificates, queued int) {
+		db.QueryRow("SELECT count(*) FROM certificates WHERE issuer = 'CN=Dispatch CA'").Scan(&certificates)
+		db.QueryRow("SELECT count(*) FROM alert_outbox WHERE notifier = 'dispatch'").Scan(&queued)
+		return
+	}
+
+	for i, fail := range []bool{true, false} {
+		r := record{Domain: "mbernhard.com", Cert: "cert", SHA256: strings.Repeat("a", 64),
+			TBSSHA256: strings.Repeat("b", 64), Serial: "2a", Issuer: "CN=Dispatch CA",
+			SPKISHA256: strings.Repeat("c", 64), Reason: reasonWatched}
+		err := r.createCertificate(db, func(tx *sql.Tx) error {
+			if err := al.dispatch(tx, newAlert(&r, "web")); err != nil {
+				return err
+			}
+			if fail {
+				return errors.New("crashed before commit")
+			}
+			return nil
+		})
+		if (err != nil) != fail {
+			t.Errorf("Attempt %d: expected failure %v, got %v", i, fail, err)
+		}
+		certificates, queued := count()
+		if fail && (certificates != 0 || queued != 0) {
+			t.Errorf("Expected neither certificate nor alert after a failure, got %d and %d", certificates, queued)
+		}
+		if !fail && (certificates != 1 || queued != 1) {
+			t.Errorf("Expected the certificate and its alert, got %d and %d", certificates, queued)
+		}
+	}
+}
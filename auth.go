@@ -0,0 +1,282 @@
+// auth.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidRole if an API key is given a role that doesn't exist
+var ErrInvalidRole = errors.New("Error invalid role")
+
+// Roles of API keys. Each role may do everything the ones before it can:
+// readers may only GET, watchlist editors may also change watched domains and
+// triage certificates, and admins may also manage keys and read the audit log.
+const (
+	roleReader = "read-only"
+	roleEditor = "watchlist-editor"
+	roleAdmin  = "admin"
+)
+
+var roleRanks = map[string]int{roleReader: 1, roleEditor: 2, roleAdmin: 3}
+
+// Most audit log entries returned at once
+const maxAuditLimit = 1000
+
+// Largest request body accepted, as every body is kept in the audit log
+const maxBodySize = 64 << 10
+
+// apiKey is a client of the API. Only the hash of the key is stored; the key
+// itself is returned once, when it's created. A key with a team may only
+// change watched domains owned by that team, unless it's an admin key.
+type apiKey struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Team    string `json:"team"`
+	Role    string `json:"role"`
+	Key     string `json:"key,omitempty"`
+	Created string `json:"created_at"`
+}
+
+// allows says if the key may use a route needing role
+func (k *apiKey) allows(role string) bool {
+	return k == nil || roleRanks[k.Role] >= roleRanks[role]
+}
+
+// owns says if the key may change watched domains with the given owner. With
+// authentication off there is no key, and everything may be changed.
+func (k *apiKey) owns(owner string) bool {
+	return k.admin() || k.Team == owner
+}
+
+// admin says if the key may change anything, whoever owns it
+func (k *apiKey) admin() bool {
+	return k == nil || k.Role == roleAdmin
+}
+
+func (k *apiKey) normalize() error {
+	k.Name = strings.TrimSpace(k.Name)
+	k.Team = strings.TrimSpace(k.Team)
+	if k.Name == "" || roleRanks[k.Role] == 0 {
+		return ErrInvalidRole
+	}
+	return nil
+}
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// createKey generates a new key and stores its hash
+func (k *apiKey) createKey(db *sql.DB) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	k.Key = hex.EncodeToString(secret)
+	return db.QueryRow(
+		`INSERT INTO api_keys(name, team, role, key_sha256) VALUES($1, $2, $3, $4)
+		RETURNING id, created_at`, k.Name, k.Team, k.Role, hashKey(k.Key)).Scan(&k.ID, &k.Created)
+}
+
+// getKeyByToken finds the key a client presented
+func getKeyByToken(db *sql.DB, token string) (apiKey, error) {
+	var k apiKey
+	err := db.QueryRow(`SELECT id, name, team, role, created_at FROM api_keys WHERE key_sha256=$1`,
+		hashKey(token)).Scan(&k.ID, &k.Name, &k.Team, &k.Role, &k.Created)
+	return k, err
+}
+
+func getKeys(db *sql.DB) ([]apiKey, error) {
+	rows, err := db.Query(`SELECT id, name, team, role, created_at FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]apiKey, 0)
+	for rows.Next() {
+		var k apiKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Team, &k.Role, &k.Created); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (k *apiKey) deleteKey(db *sql.DB) error {
+	res, err := db.Exec(`DELETE FROM api_keys WHERE id=$1`, k.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// auditEntry is a call to the API that could have changed something. The key
+// is copied rather than referenced so entries outlive deleted keys.
+type auditEntry struct {
+	ID         int64  `json:"id"`
+	KeyID      int64  `json:"key_id"`
+	KeyName    string `json:"key_name"`
+	Team       string `json:"team"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Body       string `json:"body"`
+	Status     int    `json:"status"`
+	RemoteAddr string `json:"remote_addr"`
+	Created    string `json:"created_at"`
+}
+
+func (e *auditEntry) createAudit(db *sql.DB) error {
+	return db.QueryRow(
+		`INSERT INTO audit_log(key_id, key_name, team, method, path, body, status, remote_addr)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		e.KeyID, e.KeyName, e.Team, e.Method, e.Path, e.Body, e.Status, e.RemoteAddr).Scan(&e.ID, &e.Created)
+}
+
+// setStatus records the status a call was answered with
+func (e *auditEntry) setStatus(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE audit_log SET status=$2 WHERE id=$1`, e.ID, e.Status)
+	return err
+}
+
+// getAuditLog lists the latest entries of the audit log, newest first
+func getAuditLog(db *sql.DB, limit int) ([]auditEntry, error) {
+	rows, err := db.Query(
+		`SELECT id, key_id, key_name, team, method, path, body, status, remote_addr, created_at
+		FROM audit_log ORDER BY id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]auditEntry, 0)
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.ID, &e.KeyID, &e.KeyName, &e.Team, &e.Method, &e.Path, &e.Body,
+			&e.Status, &e.RemoteAddr, &e.Created); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+type contextKey int
+
+const keyContext contextKey = 0
+
+// requestKey is the key a request was authenticated with, nil if
+// authentication is off
+func requestKey(r *http.Request) *apiKey {
+	k, _ := r.Context().Value(keyContext).(*apiKey)
+	return k
+}
+
+// bearerToken reads the key from either an Authorization: Bearer or an
+// X-API-Key header
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// authorize wraps a handler so it needs a key with at least the given role,
+// and records every call other than a GET in the audit log. The entry is
+// written before the handler runs, so nothing is changed without one; its
+// status is 0 until the handler is done.
+func (a *Monitor) authorize(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var key *apiKey
+		if a.Auth {
+			token := bearerToken(r)
+			if token == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				respondWithError(w, http.StatusUnauthorized, "Missing API key")
+				return
+			}
+			k, err := getKeyByToken(a.DB, token)
+			switch err {
+			case nil:
+			case sql.ErrNoRows:
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			default:
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !k.allows(role) {
+				respondWithError(w, http.StatusForbidden, "Forbidden")
+				return
+			}
+			key = &k
+			r = r.WithContext(context.WithValue(r.Context(), keyContext, key))
+		}
+
+		if r.Method == "GET" {
+			handler(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request payload too large")
+			return
+		} else if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		e := auditEntry{
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Body:       string(body),
+			RemoteAddr: r.RemoteAddr,
+		}
+		if key != nil {
+			e.KeyID, e.KeyName, e.Team = key.ID, key.Name, key.Team
+		}
+		if err := e.createAudit(a.DB); err != nil {
+			log.Errorf("Couldn't record %s %s in the audit log: %s", e.Method, e.Path, err)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't write the audit log")
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+
+		e.Status = rec.status
+		if err := e.setStatus(a.DB); err != nil {
+			log.Errorf("Couldn't record the status of %s %s in the audit log: %s", e.Method, e.Path, err)
+		}
+	}
+}
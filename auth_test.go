@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestKeyRoles(t *testing.T) {
+	reader := &apiKey{Role: roleReader, Team: "web"}
+	editor := &apiKey{Role: roleEditor, Team: "web"}
+	admin := &apiKey{Role: roleAdmin}
+	var none *apiKey
+
+	var tests = []struct {
+		key     *apiKey
+		role    string
+		allowed bool
+	}{
+		{reader, roleReader, true},
+		{reader, roleEditor, false},
+		{editor, roleEditor, true},
+		{editor, roleAdmin, false},
+		{admin, roleAdmin, true},
+		{&apiKey{Role: "root"}, roleReader, false},
+		{none, roleAdmin, true},
+	}
+	for _, test := range tests {
+		if test.key.allows(test.role) != test.allowed {
+			t.Errorf("Expected %v allowing %s to be %v", test.key, test.role, test.allowed)
+		}
+	}
+
+	if !editor.owns("web") || editor.owns("mail") || editor.owns("") {
+		t.Errorf("Expected an editor to own only its team's domains")
+	}
+	if !admin.owns("mail") || !none.owns("mail") {
+		t.Errorf("Expected admins and unauthenticated requests to own every domain")
+	}
+}
+
+func TestKeyNormalize(t *testing.T) {
+	k := apiKey{Name: " ci ", Team: " web ", Role: roleEditor}
+	if err := k.normalize(); err != nil || k.Name != "ci" || k.Team != "web" {
+		t.Errorf("Expected a trimmed key, got %v (%v)", k, err)
+	}
+	for _, k := range []apiKey{{Role: roleAdmin}, {Name: "ci", Role: "root"}, {Name: "ci"}} {
+		if err := k.normalize(); err != ErrInvalidRole {
+			t.Errorf("Expected %v to be invalid, got %v", k, err)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	var tests = []struct {
+		header, value, token string
+	}{
+		{"Authorization", "Bearer abc", "abc"},
+		{"Authorization", "bearer  abc ", "abc"},
+		{"Authorization", "Basic abc", ""},
+		{"X-API-Key", "abc", "abc"},
+		{"X-Other", "abc", ""},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/watchlist", nil)
+		r.Header.Set(test.header, test.value)
+		if token := bearerToken(r); token != test.token {
+			t.Errorf("Expected %s: %s to give '%s', got '%s'", test.header, test.value, test.token, token)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// backfill.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// States of a backfill
+const (
+	backfillRunning = "running"
+	backfillDone    = "done"
+	backfillFailed  = "failed"
+)
+
+// backfiller scans the history of each log for domains added while the
+// monitor is running, separately from the live tail of the log
+type backfiller struct {
+	sync.Mutex
+	// The latest configuration of each log, as updated by its downloader
+	logs map[string]LogConfig
+	// The end of the live tail's latest scan of each log. Entries before it
+	// may have been matched already, however far the tail has reported.
+	fetched  map[string]int64
+	lookback int64
+	numFetch int
+	numMatch int
+	// Bounds how many backfills scan at once
+	slots chan bool
+	// Backfills stop when ctx is cancelled, and are resumed on restart
+	ctx     context.Context
+	running sync.WaitGroup
+}
+
+var backfills *backfiller
+
+// newBackfiller creates a backfiller scanning the last lookback entries of
+// each log (all of them if lookback is 0), at most concurrency at a time,
+// until ctx is cancelled
+func newBackfiller(ctx context.Context, config Configuration, lookback int64, concurrency, numFetch, numMatch int) *backfiller {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	b := &backfiller{
+		logs:     make(map[string]LogConfig),
+		fetched:  make(map[string]int64),
+		lookback: lookback,
+		numFetch: numFetch,
+		numMatch: numMatch,
+		slots:    make(chan bool, concurrency),
+		ctx:      ctx,
+	}
+	for _, conf := range config {
+		b.logs[conf.Name] = conf
+	}
+	return b
+}
+
+// update records how far the live tail of a log has got
+func (b *backfiller) update(conf LogConfig) {
+	b.Lock()
+	defer b.Unlock()
+	b.logs[conf.Name] = conf
+}
+
+// fetching records that the live tail of a log is scanning up to end
+func (b *backfiller) fetching(name string, end int64) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.fetched[name] = end
+}
+
+func (b *backfiller) log(name string) (LogConfig, bool) {
+	b.Lock()
+	defer b.Unlock()
+	conf, ok := b.logs[name]
+	return conf, ok
+}
+
+// start backfills a newly watched domain in each log it applies to, up to
+// where the live tail has fetched
+func (b *backfiller) start(db *sql.DB, w *watchedDomain) error {
+	if b == nil {
+		return nil
+	}
+	for _, bf := range b.plan(w) {
+		if err := bf.createBackfill(db); err != nil {
+			return err
+		}
+		b.running.Add(1)
+		go b.run(db, bf)
+	}
+	return nil
+}
+
+// plan returns the backfills needed for a newly watched domain. Each ends
+// where the live tail's scan does, as entries before it may have been matched
+// before the domain was watched, and those after won't be.
+func (b *backfiller) plan(w *watchedDomain) []backfill {
+	b.Lock()
+	defer b.Unlock()
+
+	var planned []backfill
+	for name, conf := range b.logs {
+		if w.CTServer != "" && w.CTServer != name {
+			continue
+		}
+		bf := backfill{
+			Domain:   w.pattern(),
+			CTServer: name,
+			EndIndex: conf.LastIndex,
+			State:    backfillRunning,
+		}
+		if end := b.fetched[name]; end > bf.EndIndex {
+			bf.EndIndex = end
+		}
+		if b.lookback > 0 && bf.EndIndex > b.lookback {
+			bf.StartIndex = bf.EndIndex - b.lookback
+		}
+		bf.NextIndex = bf.StartIndex
+		planned = append(planned, bf)
+	}
+	return planned
+}
+
+// resume restarts the backfills that were running when the monitor stopped
+func (b *backfiller) resume(db *sql.DB) error {
+	running, err := getBackfills(db, backfillRunning)
+	if err != nil {
+		return err
+	}
+	for _, bf := range running {
+		b.running.Add(1)
+		go b.run(db, bf)
+	}
+	return nil
+}
+
+// wait for the backfills to stop once the backfiller's context is cancelled
+func (b *backfiller) wait() {
+	b.running.Wait()
+}
+
+func (b *backfiller) run(db *sql.DB, bf backfill) {
+	defer b.running.Done()
+	select {
+	case b.slots <- true:
+	case <-b.ctx.Done():
+		return
+	}
+	defer func() { <-b.slots }()
+
+	conf, ok := b.log(bf.CTServer)
+	if !ok {
+		bf.finishBackfill(db, ErrUnknownLog)
+		return
+	}
+	if bf.NextIndex >= bf.EndIndex {
+		bf.finishBackfill(db, nil)
+		return
+	}
+
+	log.Noticef("Backfilling %s in %s from %d to %d", bf.Domain, bf.CTServer, bf.NextIndex, bf.EndIndex)
+	progress := func(index int64) {
+		if err := bf.progressBackfill(db, index); err != nil {
+			log.Noticef("Couldn't record backfill progress: %s", err)
+		}
+	}
+	for {
+		index, err := b.scan(conf, bf, progress)
+		switch {
+		case b.ctx.Err() != nil:
+			// Still running, to be resumed from here
+			progress(index)
+			return
+		case err == ErrUnstored || err == ErrTreeHead:
+			// Scan again later from the first certificate that wasn't
+			// stored, or once the log can be reached
+			if err == ErrTreeHead {
+				log.Noticef("Couldn't connect to %s to backfill %s, retrying in %s", bf.CTServer, bf.Domain, scanInterval)
+			}
+			bf.NextIndex = index
+			progress(index)
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(scanInterval):
+			}
+		default:
+			bf.finishBackfill(db, err)
+			return
+		}
+	}
+}
+
+// scan runs one scan of a backfill from where it has got to
+func (b *backfiller) scan(conf LogConfig, bf backfill, progress func(int64)) (int64, error) {
+	matcher, err := backfillMatcher(conf, bf.Domain)
+	if err != nil {
+		return bf.NextIndex, err
+	}
+	logServerConnection := NewWithOffset(b.ctx, conf.Url, conf.BucketSize, bf.NextIndex)
+	if logServerConnection == nil {
+		return bf.NextIndex, ErrTreeHead
+	}
+	s := logScan{
+		name:      conf.Name,
+		client:    logServerConnection.logClient,
+		start:     bf.NextIndex,
+		end:       bf.EndIndex,
+		batchSize: conf.BucketSize,
+		numFetch:  b.numFetch,
+		numMatch:  b.numMatch,
+		process:   matchEntry(conf, matcher),
+	}
+	if logServerConnection.treeSize < s.end {
+		s.end = logServerConnection.treeSize
+	}
+	return scanLog(b.ctx, s, progress)
+}
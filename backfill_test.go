@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBackfillPlan(t *testing.T) {
+	config := Configuration{{Name: "testtube", LastIndex: 100}, {Name: "argon", LastIndex: 50}}
+	b := newBackfiller(context.Background(), config, 0, 1, 1, 1)
+
+	// The tail has fetched up to 500 but only reported processing up to 100
+	b.fetching("testtube", 500)
+	planned := b.plan(&watchedDomain{Domain: "example.com", Type: "suffix", CTServer: "testtube"})
+	if len(planned) != 1 || planned[0].CTServer != "testtube" || planned[0].EndIndex != 500 ||
+		planned[0].StartIndex != 0 || planned[0].NextIndex != 0 {
+		t.Errorf("Expected one backfill of testtube up to what the tail fetched, got %+v", planned)
+	}
+
+	// A log the tail hasn't started scanning ends where it last got to
+	planned = b.plan(&watchedDomain{Domain: "example.com", Type: "suffix", CTServer: "argon"})
+	if len(planned) != 1 || planned[0].EndIndex != 50 {
+		t.Errorf("Expected a backfill of argon up to its index, got %+v", planned)
+	}
+
+	b.lookback = 200
+	if planned = b.plan(&watchedDomain{Domain: "example.com", Type: "suffix"}); len(planned) != 2 {
+		t.Fatalf("Expected a backfill of each log, got %+v", planned)
+	}
+	for _, bf := range planned {
+		if bf.CTServer == "testtube" && (bf.StartIndex != 300 || bf.NextIndex != 300) {
+			t.Errorf("Expected the lookback to count back from what the tail fetched, got %+v", bf)
+		}
+	}
+}
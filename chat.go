@@ -0,0 +1,268 @@
+// chat.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for chatConfig
+const (
+	defaultChatInterval  = time.Minute
+	defaultCollapseAfter = 3
+	// Most names listed in a collapsed message
+	maxCollapsedNames = 10
+	// Most alerts claimed at once. Slack and Mattermost take about one post a
+	// second, so this keeps a batch well inside the outbox lease
+	maxChatBatch = 100
+	// Shortest gap between two posts
+	chatPostInterval = time.Second
+)
+
+// chatConfig is a Slack or Mattermost incoming webhook. Alerts are held until
+// the end of each Interval, so a burst of certificates arrives together, and
+// more than CollapseAfter certificates for one domain from one issuer are
+// summed up in a single message.
+type chatConfig struct {
+	Name          string `json:"name"`
+	URL           string `json:"url"`
+	Channel       string `json:"channel"`
+	Username      string `json:"username"`
+	Interval      string `json:"interval"`
+	CollapseAfter int    `json:"collapse_after"`
+	alertRoute
+}
+
+type chatNotifier struct {
+	chatConfig
+	interval time.Duration
+	client   *http.Client
+
+	// The time of the last post, to keep under the webhook's rate limit
+	mu       sync.Mutex
+	pace     time.Duration
+	lastPost time.Time
+}
+
+// chatMessage is the incoming webhook payload both Slack and Mattermost take
+type chatMessage struct {
+	Text        string           `json:"text"`
+	Channel     string           `json:"channel,omitempty"`
+	Username    string           `json:"username,omitempty"`
+	Attachments []chatAttachment `json:"attachments"`
+}
+
+type chatAttachment struct {
+	Fallback  string      `json:"fallback"`
+	Color     string      `json:"color"`
+	Title     string      `json:"title"`
+	TitleLink string      `json:"title_link,omitempty"`
+	Fields    []chatField `json:"fields"`
+}
+
+type chatField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func newChatNotifier(conf chatConfig, client *http.Client) (*chatNotifier, error) {
+	n := &chatNotifier{chatConfig: conf, interval: defaultChatInterval, client: client, pace: chatPostInterval}
+	if conf.Interval != "" {
+		interval, err := time.ParseDuration(conf.Interval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("chat %s: bad interval %q", conf.Name, conf.Interval)
+		}
+		n.interval = interval
+	}
+	if n.CollapseAfter <= 0 {
+		n.CollapseAfter = defaultCollapseAfter
+	}
+	return n, nil
+}
+
+func (n *chatNotifier) Name() string {
+	return "chat:" + n.chatConfig.Name
+}
+
+// Wants leaves out expected certificates, as webhooks do
+func (n *chatNotifier) Wants(a *alert) bool {
+	return a.Verdict != verdictExpected && n.wants(a)
+}
+
+func (n *chatNotifier) MaxBatch() int {
+	return maxChatBatch
+}
+
+// Due holds an alert until the end of the current interval
+func (n *chatNotifier) Due(a *alert, now time.Time) time.Time {
+	return now.Truncate(n.interval).Add(n.interval)
+}
+
+// Split puts the alerts for each registered domain and issuer in one message
+func (n *chatNotifier) Split(alerts []alert) [][]alert {
+	var keys []string
+	groups := make(map[string][]alert)
+	for _, a := range alerts {
+		key := chatGroup(a)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], a)
+	}
+	messages := make([][]alert, len(keys))
+	for i, key := range keys {
+		messages[i] = groups[key]
+	}
+	return messages
+}
+
+// chatGroup is the registered domain and issuer of an alert
+func chatGroup(a alert) string {
+	label, suffix := splitDomain(strings.TrimPrefix(a.Domain, "*."))
+	return label + "." + suffix + "\x00" + a.Issuer
+}
+
+// chatEscaper escapes the characters Slack and Mattermost read as markup, so
+// a name such as <!channel> on a certificate is shown rather than acted on
+var chatEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// chatEscape escapes everything in an alert that came from a certificate
+func chatEscape(a alert) alert {
+	a.Domain = chatEscaper.Replace(a.Domain)
+	a.Issuer = chatEscaper.Replace(a.Issuer)
+	names := make([]string, len(a.Names))
+	for i, name := range a.Names {
+		names[i] = chatEscaper.Replace(name)
+	}
+	a.Names = names
+	return a
+}
+
+// Deliver posts one message per registered domain and issuer
+func (n *chatNotifier) Deliver(alerts []alert) error {
+	for _, group := range n.Split(alerts) {
+		escaped := make([]alert, len(group))
+		for i, a := range group {
+			escaped[i] = chatEscape(a)
+		}
+		group = escaped
+		msg := chatMessage{Channel: n.Channel, Username: n.Username}
+		if len(group) > n.CollapseAfter {
+			domain := strings.SplitN(chatGroup(group[0]), "\x00", 2)[0]
+			msg.Text = fmt.Sprintf("%d certificates for %s from %s", len(group), domain, group[0].Issuer)
+			msg.Attachments = []chatAttachment{collapsedAttachment(msg.Text, group)}
+		} else {
+			msg.Text = fmt.Sprintf("%d certificates for %s", len(group), group[0].Domain)
+			if len(group) == 1 {
+				msg.Text = "Certificate for " + group[0].Domain
+			}
+			for _, a := range group {
+				msg.Attachments = append(msg.Attachments, alertAttachment(a))
+			}
+		}
+		if err := n.post(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *chatNotifier) post(msg chatMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	if wait := n.pace - time.Since(n.lastPost); wait > 0 {
+		time.Sleep(wait)
+	}
+	n.lastPost = time.Now()
+	n.mu.Unlock()
+	resp, err := n.client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("chat %s returned %s", n.chatConfig.Name, resp.Status)
+	}
+	return nil
+}
+
+func alertColor(a alert) string {
+	if a.Reason != reasonWatched {
+		return "danger"
+	}
+	return "warning"
+}
+
+func validity(a alert) string {
+	return a.NotBefore.UTC().Format("2006-01-02") + " to " + a.NotAfter.UTC().Format("2006-01-02")
+}
+
+func alertAttachment(a alert) chatAttachment {
+	title := a.Domain
+	if a.Reason != reasonWatched {
+		title = fmt.Sprintf("%s (%s look-alike, %.2f)", a.Domain, a.Reason, a.Score)
+	}
+	return chatAttachment{
+		Fallback:  "Certificate for " + a.Domain + " from " + a.Issuer,
+		Color:     alertColor(a),
+		Title:     title,
+		TitleLink: "https://crt.sh/?sha256=" + a.SHA256,
+		Fields: []chatField{
+			{"Domain", a.Domain, true},
+			{"Issuer", a.Issuer, true},
+			{"Validity", validity(a), true},
+			{"Log", fmt.Sprintf("%s #%d", a.CTServer, a.LogIndex), true},
+		},
+	}
+}
+
+// collapsedAttachment sums up many certificates for one domain and issuer
+func collapsedAttachment(text string, group []alert) chatAttachment {
+	var names, logs []string
+	seenLog := make(map[string]bool)
+	color := "warning"
+	first, last := group[0], group[0]
+	for _, a := range group {
+		if len(names) < maxCollapsedNames {
+			names = append(names, a.Domain)
+		}
+		if !seenLog[a.CTServer] {
+			seenLog[a.CTServer] = true
+			logs = append(logs, a.CTServer)
+		}
+		if alertColor(a) == "danger" {
+			color = "danger"
+		}
+		if a.NotBefore.Before(first.NotBefore) {
+			first = a
+		}
+		if a.NotAfter.After(last.NotAfter) {
+			last = a
+		}
+	}
+	if len(group) > len(names) {
+		names = append(names, fmt.Sprintf("and %d more", len(group)-len(names)))
+	}
+
+	return chatAttachment{
+		Fallback: text,
+		Color:    color,
+		Title:    text,
+		Fields: []chatField{
+			{"Names", strings.Join(names, ", "), false},
+			{"Issuer", first.Issuer, true},
+			{"Validity", validity(alert{NotBefore: first.NotBefore, NotAfter: last.NotAfter}), true},
+			{"Logs", strings.Join(logs, ", "), true},
+		},
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatDeliver(t *testing.T) {
+	var got []chatMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg chatMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("Couldn't decode message: %s", err)
+		}
+		got = append(got, msg)
+	}))
+	defer server.Close()
+
+	n, err := newChatNotifier(chatConfig{Name: "ops", URL: server.URL, Channel: "#certs"}, server.Client())
+	if err != nil {
+		t.Fatalf("Couldn't create notifier: %s", err)
+	}
+
+	batch := []alert{{Domain: "mbernhart.com", Issuer: "CN=Other CA", Reason: reasonTypo, Score: 0.9}}
+	for i := 0; i < 20; i++ {
+		batch = append(batch, alert{Domain: "host" + strconv.Itoa(i) + ".mbernhard.com", Issuer: "CN=Test CA", Reason: reasonWatched})
+	}
+	if messages := n.Split(batch); len(messages) != 2 || len(messages[1]) != 20 {
+		t.Errorf("Expected the look-alike alone and the burst together, got %d messages", len(messages))
+	}
+	n.pace = 50 * time.Millisecond
+	start := time.Now()
+	if err := n.Deliver(batch); err != nil {
+		t.Fatalf("Unexpected error delivering: %s", err)
+	}
+	if time.Since(start) < n.pace {
+		t.Errorf("Expected posts to be spaced out")
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(got))
+	}
+	if len(got[0].Attachments) != 1 || got[0].Attachments[0].Color != "danger" || got[0].Channel != "#certs" {
+		t.Errorf("Expected a single look-alike attachment, got %v", got[0])
+	}
+	if got[1].Text != "20 certificates for mbernhard.com from CN=Test CA" || len(got[1].Attachments) != 1 {
+		t.Errorf("Expected the burst to be collapsed, got %v", got[1])
+	}
+	if names := got[1].Attachments[0].Fields[0].Value; !strings.HasSuffix(names, "and 10 more") {
+		t.Errorf("Expected 10 names listed, got %s", names)
+	}
+}
+
+func TestChatEscape(t *testing.T) {
+	var got []chatMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg chatMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("Couldn't decode message: %s", err)
+		}
+		got = append(got, msg)
+	}))
+	defer server.Close()
+
+	n, err := newChatNotifier(chatConfig{Name: "ops", URL: server.URL, CollapseAfter: 1}, server.Client())
+	if err != nil {
+		t.Fatalf("Couldn't create notifier: %s", err)
+	}
+	n.pace = 0
+
+	single := alert{Domain: "<!channel>", Names: []string{"<!channel>"}, Issuer: "CN=<https://evil|bank.com>", Reason: reasonWatched}
+	collapsed := []alert{
+		{Domain: "a&b.mbernhard.com", Issuer: "CN=<b>CA</b>", Reason: reasonWatched},
+		{Domain: "<@here>.mbernhard.com", Issuer: "CN=<b>CA</b>", Reason: reasonWatched},
+	}
+	if err := n.Deliver(append([]alert{single}, collapsed...)); err != nil {
+		t.Fatalf("Unexpected error delivering: %s", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(got))
+	}
+	for _, msg := range got {
+		texts := []string{msg.Text}
+		for _, attachment := range msg.Attachments {
+			texts = append(texts, attachment.Fallback, attachment.Title)
+			for _, field := range attachment.Fields {
+				texts = append(texts, field.Value)
+			}
+		}
+		for _, text := range texts {
+			if strings.ContainsAny(text, "<>") {
+				t.Errorf("Expected certificate fields to be escaped, got %q", text)
+			}
+		}
+	}
+	if got[0].Text != "Certificate for &lt;!channel&gt;" {
+		t.Errorf("Expected the name shown as text, got %q", got[0].Text)
+	}
+	if names := got[1].Attachments[0].Fields[0].Value; names != "a&amp;b.mbernhard.com, &lt;@here&gt;.mbernhard.com" {
+		t.Errorf("Expected the collapsed names escaped, got %q", names)
+	}
+}
+
+func TestChatDue(t *testing.T) {
+	n, err := newChatNotifier(chatConfig{Interval: "5m"}, nil)
+	if err != nil {
+		t.Fatalf("Couldn't create notifier: %s", err)
+	}
+	now := time.Date(2018, 3, 14, 15, 2, 10, 0, time.UTC)
+	if due := n.Due(&alert{}, now); !due.Equal(time.Date(2018, 3, 14, 15, 5, 0, 0, time.UTC)) {
+		t.Errorf("Expected the end of the interval, got %s", due)
+	}
+
+	if _, err := newChatNotifier(chatConfig{Interval: "soon"}, nil); err == nil {
+		t.Errorf("Expected an error for a bad interval")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
 
@@ -15,6 +16,8 @@ var (
 	ErrLogEntries = errors.New("Error ...")
 	// ErrCertificateNotFound if we cannot find a certificate
 	ErrCertificateNotFound = errors.New("Error certificate not found")
+	// ErrUnknownLog if there's no log by that name in the configuration
+	ErrUnknownLog = errors.New("Error unknown log")
 )
 
 // LogServerConnection Struct containing the CT log connection and relevant data
@@ -27,8 +30,32 @@ type LogServerConnection struct {
 	end        int64
 }
 
-func merkleTreeSize(logClient *client.LogClient) (uint64, error) {
-	treeHead, err := logClient.GetSTH()
+// withContext makes a call to the log, giving up on it if ctx is done first.
+// The log client can't be interrupted, so an abandoned call finishes in the
+// background, bounded by the client's request timeout; nothing waits for its
+// result, so its goroutine then exits.
+func withContext(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func merkleTreeSize(ctx context.Context, logClient *client.LogClient) (uint64, error) {
+	var treeHead *ct.SignedTreeHead
+	err := withContext(ctx, func() (err error) {
+		treeHead, err = logClient.GetSTH()
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -51,7 +78,7 @@ func leafCertificate(logEntry ct.LogEntry) ([]byte, error) {
 }
 
 // New Create a new connection to server <uri>, downloading <bucketSize> entries at a time
-func New(uri string, bucketSize int64) *LogServerConnection {
+func New(ctx context.Context, uri string, bucketSize int64) *LogServerConnection {
 	var c LogServerConnection
 	var err error
 	c.logClient = client.New(uri)
@@ -59,7 +86,7 @@ func New(uri string, bucketSize int64) *LogServerConnection {
 		log.Error(err)
 		return nil
 	}
-	treeSize, err := merkleTreeSize(c.logClient)
+	treeSize, err := merkleTreeSize(ctx, c.logClient)
 	if err != nil {
 		log.Error(err)
 		return nil
@@ -77,8 +104,8 @@ func New(uri string, bucketSize int64) *LogServerConnection {
 }
 
 // NewWithOffset Same as New, but starts at entry <offset> in the log
-func NewWithOffset(uri string, bucketSize int64, start int64) *LogServerConnection {
-	c := New(uri, bucketSize)
+func NewWithOffset(ctx context.Context, uri string, bucketSize int64, start int64) *LogServerConnection {
+	c := New(ctx, uri, bucketSize)
 
 	if c == nil {
 		return nil
@@ -97,21 +124,24 @@ func (c *LogServerConnection) slideBucket() {
 }
 
 // GetLogEntries get one window's worth of entries, slide window
-func (c *LogServerConnection) GetLogEntries() ([]ct.LogEntry, error) {
+func (c *LogServerConnection) GetLogEntries(ctx context.Context) ([]ct.LogEntry, error) {
 	if c.end >= c.treeSize {
 		c.treeSize -= 1
 		c.end = c.treeSize
 	}
 
 	log.Info("Requesting Tree Range: %d-%d/%d\n", c.start, c.end, c.treeSize)
-	entries, err := c.logClient.GetEntries(c.start, c.end)
-
-	log.Info("Entries length: %d", len(entries))
-
+	var entries []ct.LogEntry
+	err := withContext(ctx, func() (err error) {
+		entries, err = c.logClient.GetEntries(c.start, c.end)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	log.Info("Entries length: %d", len(entries))
+
 	if len(entries) < int(c.bucketSize) && c.end != c.treeSize {
 		c.end = c.start + int64(len(entries))
 		c.bucketSize = int64(len(entries))
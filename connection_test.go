@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 )
 
@@ -29,7 +30,7 @@ func TestNew(t *testing.T) {
 	uri := testtube
 	bucketSize := int64(1)
 
-	lSC := New(uri, bucketSize)
+	lSC := New(context.Background(), uri, bucketSize)
 
 	testLSC(lSC, bucketSize, int64(0), t)
 
@@ -40,7 +41,7 @@ func TestNewWithOffset0(t *testing.T) {
 	bucketSize := int64(1)
 	offset := int64(0)
 
-	lSC := NewWithOffset(uri, bucketSize, offset)
+	lSC := NewWithOffset(context.Background(), uri, bucketSize, offset)
 
 	testLSC(lSC, bucketSize, offset, t)
 
@@ -50,7 +51,7 @@ func TestNewWithOffset1(t *testing.T) {
 	bucketSize := int64(1)
 	offset := int64(1)
 
-	lSC := NewWithOffset(testtube, bucketSize, offset)
+	lSC := NewWithOffset(context.Background(), testtube, bucketSize, offset)
 
 	testLSC(lSC, bucketSize, offset, t)
 
@@ -59,7 +60,7 @@ func TestNewWithOffset1(t *testing.T) {
 func TestSlideBucket(t *testing.T) {
 	bucketSize := int64(10)
 
-	lSC := New(testtube, bucketSize)
+	lSC := New(context.Background(), testtube, bucketSize)
 
 	lSC.slideBucket()
 
@@ -72,9 +73,9 @@ func TestSlideBucket(t *testing.T) {
 func TestGetLogEntries(t *testing.T) {
 	bucketSize := int64(10)
 
-	lSC := New(testtube, bucketSize)
+	lSC := New(context.Background(), testtube, bucketSize)
 
-	entries, err := lSC.GetLogEntries()
+	entries, err := lSC.GetLogEntries(context.Background())
 
 	if err != nil {
 		t.Errorf("Couldn't get log entries!")
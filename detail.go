@@ -0,0 +1,268 @@
+// detail.go
+
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+// ErrSCTList if an embedded SCT list can't be taken apart
+var ErrSCTList = errors.New("Error malformed SCT list")
+
+// Names of the algorithms and extensions found in web PKI certificates
+var oidNames = map[string]string{
+	"1.2.840.113549.1.1.5":    "SHA1-RSA",
+	"1.2.840.113549.1.1.11":   "SHA256-RSA",
+	"1.2.840.113549.1.1.12":   "SHA384-RSA",
+	"1.2.840.113549.1.1.13":   "SHA512-RSA",
+	"1.2.840.113549.1.1.10":   "RSA-PSS",
+	"1.2.840.10045.4.1":       "ECDSA-SHA1",
+	"1.2.840.10045.4.3.2":     "ECDSA-SHA256",
+	"1.2.840.10045.4.3.3":     "ECDSA-SHA384",
+	"1.2.840.10045.4.3.4":     "ECDSA-SHA512",
+	"1.3.101.112":             "Ed25519",
+	"2.5.29.14":               "subjectKeyIdentifier",
+	"2.5.29.15":               "keyUsage",
+	"2.5.29.17":               "subjectAltName",
+	"2.5.29.19":               "basicConstraints",
+	"2.5.29.30":               "nameConstraints",
+	"2.5.29.31":               "cRLDistributionPoints",
+	"2.5.29.32":               "certificatePolicies",
+	"2.5.29.35":               "authorityKeyIdentifier",
+	"2.5.29.37":               "extKeyUsage",
+	"1.3.6.1.5.5.7.1.1":       "authorityInfoAccess",
+	"1.3.6.1.5.5.7.1.24":      "tlsFeature",
+	"1.3.6.1.4.1.11129.2.4.2": "signedCertificateTimestampList",
+	"1.3.6.1.4.1.11129.2.4.3": "ctPoison",
+}
+
+// certificateDetail is a certificate taken apart
+type certificateDetail struct {
+	ID                 int64             `json:"id"`
+	SHA256             string            `json:"sha256"`
+	TBSSHA256          string            `json:"tbs_sha256"`
+	Precert            bool              `json:"precert"`
+	Version            int               `json:"version"`
+	Serial             string            `json:"serial"`
+	Subject            string            `json:"subject"`
+	Issuer             string            `json:"issuer"`
+	DNSNames           []string          `json:"dns_names"`
+	IPAddresses        []string          `json:"ip_addresses"`
+	EmailAddresses     []string          `json:"email_addresses"`
+	NotBefore          time.Time         `json:"not_before"`
+	NotAfter           time.Time         `json:"not_after"`
+	KeyType            string            `json:"key_type"`
+	KeySize            int               `json:"key_size"`
+	SPKISHA256         string            `json:"spki_sha256"`
+	SignatureAlgorithm string            `json:"signature_algorithm"`
+	IsCA               bool              `json:"is_ca"`
+	Extensions         []extensionDetail `json:"extensions"`
+	SCTs               []sctDetail       `json:"scts"`
+	Policies           []string          `json:"policies"`
+	Chain              []chainDetail     `json:"chain"`
+	Sightings          []sighting        `json:"logs"`
+	// Set if the certificate couldn't be parsed, leaving only the stored fields
+	Error string `json:"error,omitempty"`
+}
+
+type extensionDetail struct {
+	OID      string `json:"oid"`
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+}
+
+// sctDetail is an SCT embedded in a certificate (RFC 6962 3.2)
+type sctDetail struct {
+	Version   int       `json:"version"`
+	LogID     string    `json:"log_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// chainDetail is a certificate from the chain a certificate was logged with
+type chainDetail struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	SHA256    string    `json:"sha256"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// certificateDER returns the DER stored for a certificate, which for an
+// issuance only seen as a precertificate is its TBSCertificate
+func certificateDER(r *record) ([]byte, error) {
+	block, _ := pem.Decode([]byte(r.Cert))
+	if block == nil {
+		return nil, ErrCertificateNotFound
+	}
+	return block.Bytes, nil
+}
+
+// newCertificateDetail parses a stored certificate. A certificate the parser
+// can't handle is still described by what was stored for it.
+func newCertificateDetail(r *record) (certificateDetail, error) {
+	d := certificateDetail{
+		ID:        r.ID,
+		SHA256:    r.SHA256,
+		TBSSHA256: r.TBSSHA256,
+		Precert:   r.Precert,
+		Sightings: r.Sightings,
+	}
+	der, err := certificateDER(r)
+	if err != nil {
+		return d, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil && r.Precert {
+		cert, err = x509.ParseTBSCertificate(der)
+	}
+	if err != nil {
+		d.Error = err.Error()
+		return d, nil
+	}
+
+	d.Version = cert.Version
+	d.Serial = r.Serial
+	d.Subject = distinguishedName(cert.Subject)
+	d.Issuer = distinguishedName(cert.Issuer)
+	d.DNSNames = cert.DNSNames
+	d.EmailAddresses = cert.EmailAddresses
+	for _, ip := range cert.IPAddresses {
+		d.IPAddresses = append(d.IPAddresses, ip.String())
+	}
+	d.NotBefore, d.NotAfter = cert.NotBefore, cert.NotAfter
+	d.KeyType, d.KeySize = publicKeyType(cert.PublicKey)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	d.SPKISHA256 = hex.EncodeToString(spki[:])
+	d.IsCA = cert.BasicConstraintsValid && cert.IsCA
+
+	tbs := cert.RawTBSCertificate
+	if len(tbs) == 0 {
+		tbs = der
+	}
+	d.SignatureAlgorithm = signatureAlgorithm(tbs)
+
+	d.Extensions = make([]extensionDetail, 0, len(cert.Extensions))
+	d.SCTs = make([]sctDetail, 0)
+	for _, ext := range cert.Extensions {
+		oid := ext.Id.String()
+		d.Extensions = append(d.Extensions, extensionDetail{oid, oidNames[oid], ext.Critical})
+		if ext.Id.Equal(oidSCTList) {
+			if scts, err := parseSCTList(ext.Value); err == nil {
+				d.SCTs = scts
+			}
+		}
+	}
+	d.Policies = make([]string, 0, len(cert.PolicyIdentifiers))
+	for _, policy := range cert.PolicyIdentifiers {
+		d.Policies = append(d.Policies, policy.String())
+	}
+
+	d.Chain = make([]chainDetail, 0)
+	for rest := []byte(r.chain); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		hash := sha256.Sum256(block.Bytes)
+		d.Chain = append(d.Chain, chainDetail{
+			Subject:   distinguishedName(c.Subject),
+			Issuer:    distinguishedName(c.Issuer),
+			SHA256:    hex.EncodeToString(hash[:]),
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+		})
+	}
+	return d, nil
+}
+
+func publicKeyType(key interface{}) (string, int) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", k.Curve.Params().BitSize
+	case *dsa.PublicKey:
+		return "DSA", k.P.BitLen()
+	default:
+		return "unknown", 0
+	}
+}
+
+// signatureAlgorithm names the signature field of a TBSCertificate
+func signatureAlgorithm(tbs []byte) string {
+	var outer asn1.RawValue
+	if _, err := asn1.Unmarshal(tbs, &outer); err != nil {
+		return ""
+	}
+	rest := outer.Bytes
+	for len(rest) > 0 {
+		var value asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &value); err != nil {
+			return ""
+		}
+		// Skip the optional [0] version and the serial number
+		if value.Class == asn1.ClassContextSpecific || value.Tag == asn1.TagInteger {
+			continue
+		}
+		var alg struct {
+			Algorithm  asn1.ObjectIdentifier
+			Parameters asn1.RawValue `asn1:"optional"`
+		}
+		if _, err := asn1.Unmarshal(value.FullBytes, &alg); err != nil {
+			return ""
+		}
+		if name, ok := oidNames[alg.Algorithm.String()]; ok {
+			return name
+		}
+		return alg.Algorithm.String()
+	}
+	return ""
+}
+
+// parseSCTList reads the SCTs from a signedCertificateTimestampList extension
+func parseSCTList(value []byte) ([]sctDetail, error) {
+	var list []byte
+	if _, err := asn1.Unmarshal(value, &list); err != nil {
+		return nil, ErrSCTList
+	}
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, ErrSCTList
+	}
+
+	scts := make([]sctDetail, 0)
+	for rest := list[2:]; len(rest) > 0; {
+		if len(rest) < 2 {
+			return nil, ErrSCTList
+		}
+		length := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+length || length < 41 {
+			return nil, ErrSCTList
+		}
+		sct := rest[2 : 2+length]
+		rest = rest[2+length:]
+
+		ms := int64(binary.BigEndian.Uint64(sct[33:41]))
+		scts = append(scts, sctDetail{
+			Version:   int(sct[0]),
+			LogID:     hex.EncodeToString(sct[1:33]),
+			Timestamp: time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC(),
+		})
+	}
+	return scts, nil
+}
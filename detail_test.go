@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificateDetail(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One SCT: version, log ID, timestamp, no extensions, then a signature
+	sct := []byte{0}
+	sct = append(sct, make([]byte, 32)...)
+	sct[1] = 0xab
+	sct = append(sct, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(sct[33:], 1500000000123)
+	sct = append(sct, 0, 0, 4, 3, 0, 0)
+	list := make([]byte, 4, 4+len(sct))
+	binary.BigEndian.PutUint16(list, uint16(2+len(sct)))
+	binary.BigEndian.PutUint16(list[2:], uint16(len(sct)))
+	list = append(list, sct...)
+	sctList, _ := asn1.Marshal(list)
+
+	template := x509.Certificate{
+		SerialNumber:      big.NewInt(42),
+		Subject:           pkix.Name{CommonName: "mbernhard.com"},
+		Issuer:            pkix.Name{CommonName: "mbernhard.com"},
+		DNSNames:          []string{"mbernhard.com", "www.mbernhard.com"},
+		NotBefore:         time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:          time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+		PolicyIdentifiers: []asn1.ObjectIdentifier{{2, 23, 140, 1, 2, 1}},
+		ExtraExtensions:   []pkix.Extension{{Id: oidSCTList, Value: sctList}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	d, err := newCertificateDetail(&record{ID: 7, Cert: cert, Serial: "2a", chain: cert})
+	if err != nil {
+		t.Fatalf("Couldn't parse certificate: %s", err)
+	}
+	if d.Error != "" {
+		t.Fatalf("Expected no parse error, got %s", d.Error)
+	}
+	if d.ID != 7 || d.Serial != "2a" || !strings.Contains(d.Subject, "CN=mbernhard.com") {
+		t.Errorf("Unexpected identity %d %s %s", d.ID, d.Serial, d.Subject)
+	}
+	if len(d.DNSNames) != 2 || d.DNSNames[1] != "www.mbernhard.com" {
+		t.Errorf("Expected both SANs, got %v", d.DNSNames)
+	}
+	if d.KeyType != "ECDSA" || d.KeySize != 256 {
+		t.Errorf("Expected an ECDSA 256 key, got %s %d", d.KeyType, d.KeySize)
+	}
+	if d.SignatureAlgorithm != "ECDSA-SHA256" {
+		t.Errorf("Expected ECDSA-SHA256, got %s", d.SignatureAlgorithm)
+	}
+	if len(d.Policies) != 1 || d.Policies[0] != "2.23.140.1.2.1" {
+		t.Errorf("Expected the DV policy, got %v", d.Policies)
+	}
+
+	var named bool
+	for _, ext := range d.Extensions {
+		if ext.Name == "signedCertificateTimestampList" {
+			named = true
+		}
+	}
+	if !named {
+		t.Errorf("Expected the SCT list among the extensions, got %v", d.Extensions)
+	}
+	if len(d.SCTs) != 1 {
+		t.Fatalf("Expected one SCT, got %v", d.SCTs)
+	}
+	if !strings.HasPrefix(d.SCTs[0].LogID, "ab00") || !d.SCTs[0].Timestamp.Equal(time.Unix(1500000000, 123000000)) {
+		t.Errorf("Unexpected SCT %+v", d.SCTs[0])
+	}
+	if len(d.Chain) != 1 || d.Chain[0].SHA256 == "" {
+		t.Errorf("Expected one chain certificate, got %v", d.Chain)
+	}
+
+	d, err = newCertificateDetail(&record{Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}))})
+	if err != nil || d.Error == "" {
+		t.Errorf("Expected a parse error in the detail, got %v", err)
+	}
+	if _, err := newCertificateDetail(&record{Cert: "garbage"}); err == nil {
+		t.Errorf("Expected an error without a PEM")
+	}
+}
+
+func TestParseSCTList(t *testing.T) {
+	for _, list := range [][]byte{{}, {0, 5, 0}, {0, 3, 0, 1, 0}} {
+		value, _ := asn1.Marshal(list)
+		if _, err := parseSCTList(value); err != ErrSCTList {
+			t.Errorf("Expected %v to be malformed, got %v", list, err)
+		}
+	}
+	if _, err := parseSCTList([]byte("garbage")); err != ErrSCTList {
+		t.Errorf("Expected garbage to be malformed")
+	}
+}
@@ -0,0 +1,209 @@
+// domainindex.go
+
+package main
+
+import (
+	"strings"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+// domainIndex finds the watched hostname pattern covering a name in time
+// proportional to the number of labels in the name, however many patterns
+// are watched. Patterns are kept by the name they end at. The index is
+// persistent: with and without return a new index sharing most of the old
+// one, which readers can go on using unchanged.
+type domainIndex struct {
+	// The nameEntry of each name
+	names *pmap
+	// How many distinct patterns are watched
+	size   int
+	brands *brandIndex
+}
+
+// nameEntry counts the patterns of each kind ending at a name, as the same
+// pattern can be watched more than once, e.g. in one log and in every log
+type nameEntry struct {
+	exact, suffix, wildcard int
+	// Names directly below this one with an exact or suffix pattern, so a
+	// wildcard certificate name can be matched without visiting every name
+	children *pmap
+}
+
+func (e *nameEntry) count(kind int) *int {
+	switch kind {
+	case patternExact:
+		return &e.exact
+	case patternWildcard:
+		return &e.wildcard
+	default:
+		return &e.suffix
+	}
+}
+
+func newDomainIndex(patterns []string) *domainIndex {
+	idx := &domainIndex{brands: newBrandIndex(lookalikeDistance)}
+	for _, pattern := range patterns {
+		idx = idx.with(pattern)
+	}
+	return idx
+}
+
+func (idx *domainIndex) entry(name string) nameEntry {
+	return idx.entryHashed(name, pmapHash(name))
+}
+
+func (idx *domainIndex) entryHashed(name string, h uint64) nameEntry {
+	if v, ok := idx.names.getHashed(name, h); ok {
+		return v.(nameEntry)
+	}
+	return nameEntry{}
+}
+
+// len is the number of distinct patterns in the index
+func (idx *domainIndex) len() int {
+	if idx == nil {
+		return 0
+	}
+	return idx.size
+}
+
+// with returns the index with a pattern added, ignoring empty patterns
+func (idx *domainIndex) with(pattern string) *domainIndex {
+	p := parsePattern(pattern)
+	if p.name == "" {
+		return idx
+	}
+	next := *idx
+	e := idx.entry(p.name)
+	count := e.count(p.kind)
+	if *count++; *count == 1 {
+		next.size++
+		next.brands = idx.brands.with(p.name)
+		if p.kind != patternWildcard && e.exact+e.suffix == 1 {
+			next.names = next.adopt(p.name, true)
+		}
+	}
+	next.names = next.names.with(p.name, e)
+	return &next
+}
+
+// without returns the index with a pattern removed once, so a pattern added
+// more than once stays until it has been removed as often
+func (idx *domainIndex) without(pattern string) *domainIndex {
+	p := parsePattern(pattern)
+	e := idx.entry(p.name)
+	count := e.count(p.kind)
+	if p.name == "" || *count == 0 {
+		return idx
+	}
+	next := *idx
+	if *count--; *count == 0 {
+		next.size--
+		next.brands = idx.brands.without(p.name)
+		if p.kind != patternWildcard && e.exact+e.suffix == 0 {
+			next.names = next.adopt(p.name, false)
+		}
+	}
+	if e.exact+e.suffix+e.wildcard == 0 && e.children.len() == 0 {
+		next.names = next.names.without(p.name)
+	} else {
+		next.names = next.names.with(p.name, e)
+	}
+	return &next
+}
+
+// adopt returns the names with name added to or removed from the children of
+// its parent
+func (idx *domainIndex) adopt(name string, add bool) *pmap {
+	parent := parentDomain(name)
+	if parent == "" {
+		return idx.names
+	}
+	e := idx.entry(parent)
+	if add {
+		e.children = e.children.with(name, true)
+	} else {
+		e.children = e.children.without(name)
+	}
+	if e.exact+e.suffix+e.wildcard == 0 && e.children.len() == 0 {
+		return idx.names.without(parent)
+	}
+	return idx.names.with(parent, e)
+}
+
+// lookup returns the most specific pattern covering a name taken from a
+// certificate: an exact pattern, then a wildcard, then the deepest suffix. The
+// name may itself be a wildcard, in which case it matches if it would be valid
+// for some name a pattern covers.
+func (idx *domainIndex) lookup(name string) (string, bool) {
+	if idx == nil {
+		return "", false
+	}
+	name = normalizeName(name)
+	wildcard := strings.HasPrefix(name, "*.")
+	if wildcard {
+		name = name[2:]
+	}
+	if name == "" {
+		return "", false
+	}
+
+	// Walk down from the TLD to the name itself, a label at a time
+	var suffix, parentWildcard string
+	var e nameEntry
+	first := strings.IndexByte(name, '.') + 1
+	h := pmapHash("")
+	for i := len(name); i > 0; {
+		end := i
+		i = strings.LastIndexByte(name[:i-1], '.') + 1
+		h = pmapHashFrom(h, name[i:end])
+		if e = idx.entryHashed(name[i:], h); e.suffix > 0 {
+			suffix = name[i:]
+		}
+		// One label left means the name is directly below this one
+		if i == first && i > 0 && !wildcard && e.wildcard > 0 {
+			parentWildcard = "*." + name[i:]
+		}
+	}
+
+	switch {
+	case !wildcard && e.exact > 0:
+		return "=" + name, true
+	case wildcard && e.wildcard > 0:
+		return "*." + name, true
+	case wildcard && e.children.len() > 0:
+		var child string
+		e.children.each(func(key string, value interface{}) bool {
+			child = key
+			return false
+		})
+		if idx.entry(child).suffix > 0 {
+			return child, true
+		}
+		return "=" + child, true
+	case parentWildcard != "":
+		return parentWildcard, true
+	}
+	return suffix, suffix != ""
+}
+
+// matchCert returns the first name on the certificate covered by a pattern in
+// the index, along with that pattern
+func (idx *domainIndex) matchCert(cert *x509.Certificate) (string, string, bool) {
+	for _, name := range certNames(cert) {
+		if pattern, ok := idx.lookup(name); ok {
+			return normalizeName(name), pattern, true
+		}
+	}
+	return "", "", false
+}
+
+// lookalikeCert returns the strongest resemblance between a name on the
+// certificate and one of the patterns in the index
+func (idx *domainIndex) lookalikeCert(cert *x509.Certificate) (lookalike, bool) {
+	if idx == nil {
+		return lookalike{}, false
+	}
+	return idx.brands.checkCert(cert)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+func TestDomainIndexLookup(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"mbernhard.com", "mbernhard.com", true},
+		{"mbernhard.com", "mail.mbernhard.com", true},
+		{"mbernhard.com", "a.b.mbernhard.com", true},
+		{"mbernhard.com", "MAIL.MBERNHARD.COM.", true},
+		{"mbernhard.com", "notmbernhard.com", false},
+		{"mbernhard.com", "com", false},
+		{"mbernhard.com", "*.mbernhard.com", true},
+		{"mail.mbernhard.com", "*.mbernhard.com", true},
+		{"*.imsg.com", "a.imsg.com", true},
+		{"*.imsg.com", "*.imsg.com", true},
+		{"*.imsg.com", "imsg.com", false},
+		{"*.imsg.com", "a.b.imsg.com", false},
+		{"*.imsg.com", "*.a.imsg.com", false},
+		{"=www.cruisecheap.com", "www.cruisecheap.com", true},
+		{"=www.cruisecheap.com", "*.cruisecheap.com", true},
+		{"=www.cruisecheap.com", "a.www.cruisecheap.com", false},
+		{"=www.cruisecheap.com", "cruisecheap.com", false},
+		{"", "example.com", false},
+	}
+
+	for _, c := range cases {
+		pattern, ok := newDomainIndex([]string{c.pattern}).lookup(c.name)
+		if ok != c.match {
+			t.Errorf("%q matching %q: expected %v, got %v", c.pattern, c.name, c.match, ok)
+		} else if ok && pattern != c.pattern {
+			t.Errorf("%q matching %q: returned pattern %q", c.pattern, c.name, pattern)
+		}
+	}
+}
+
+func TestDomainIndexMostSpecific(t *testing.T) {
+	patterns := []string{"example.com", "shop.example.com", "=www.shop.example.com", "*.api.example.com"}
+	cases := []struct {
+		name    string
+		pattern string
+	}{
+		{"example.com", "example.com"},
+		{"mail.example.com", "example.com"},
+		{"shop.example.com", "shop.example.com"},
+		{"a.b.shop.example.com", "shop.example.com"},
+		{"www.shop.example.com", "=www.shop.example.com"},
+		{"a.www.shop.example.com", "shop.example.com"},
+		{"v1.api.example.com", "*.api.example.com"},
+		{"*.api.example.com", "*.api.example.com"},
+		{"a.v1.api.example.com", "example.com"},
+	}
+
+	// The answer mustn't depend on the order the patterns were added in
+	reversed := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		reversed[len(patterns)-1-i] = pattern
+	}
+	for _, idx := range []*domainIndex{newDomainIndex(patterns), newDomainIndex(reversed)} {
+		for _, c := range cases {
+			if pattern, ok := idx.lookup(c.name); !ok || pattern != c.pattern {
+				t.Errorf("Expected %q to match %q, got %q %v", c.name, c.pattern, pattern, ok)
+			}
+		}
+	}
+}
+
+func TestDomainIndexMatchCert(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "inssec.org"},
+		DNSNames: []string{"example.com", "mail.mbernhard.com"},
+	}
+
+	domain, pattern, ok := newDomainIndex([]string{"*.imsg.com", "mbernhard.com"}).matchCert(cert)
+	if !ok || domain != "mail.mbernhard.com" || pattern != "mbernhard.com" {
+		t.Errorf("Expected a match on the second SAN, got %q %q %v", domain, pattern, ok)
+	}
+
+	domain, _, ok = newDomainIndex([]string{"=inssec.org"}).matchCert(cert)
+	if !ok || domain != "inssec.org" {
+		t.Errorf("Expected a match on the subject CN, got %q %v", domain, ok)
+	}
+
+	if _, _, ok = newDomainIndex([]string{"=mbernhard.com"}).matchCert(cert); ok {
+		t.Errorf("Expected no match for an exact pattern on a subdomain")
+	}
+
+	var idx *domainIndex
+	if _, _, ok = idx.matchCert(cert); ok {
+		t.Errorf("Expected no match from a nil index")
+	}
+}
+
+func TestDomainIndexDuplicates(t *testing.T) {
+	idx := newDomainIndex([]string{"mbernhard.com", "mbernhard.com", "*.mbernhard.com", ""})
+	if idx.len() != 2 {
+		t.Errorf("Expected 2 patterns, got %d", idx.len())
+	}
+}
+
+func benchmarkDomainIndex(b *testing.B, watched int) {
+	patterns := make([]string, watched)
+	for i := range patterns {
+		patterns[i] = "domain" + strconv.Itoa(i) + ".com"
+	}
+	idx := newDomainIndex(patterns)
+
+	// Certificates with a handful of SANs, roughly one in ten of them ours
+	certs := make([]*x509.Certificate, 1000)
+	r := rand.New(rand.NewSource(1))
+	for i := range certs {
+		cert := &x509.Certificate{}
+		for j := 0; j < 4; j++ {
+			if r.Intn(40) == 0 {
+				cert.DNSNames = append(cert.DNSNames, "www.domain"+strconv.Itoa(r.Intn(watched))+".com")
+			} else {
+				cert.DNSNames = append(cert.DNSNames, "host"+strconv.Itoa(r.Int())+".example.net")
+			}
+		}
+		certs[i] = cert
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.matchCert(certs[i%len(certs)])
+	}
+}
+
+func BenchmarkDomainIndex100(b *testing.B)  { benchmarkDomainIndex(b, 100) }
+func BenchmarkDomainIndex10k(b *testing.B)  { benchmarkDomainIndex(b, 10000) }
+func BenchmarkDomainIndex100k(b *testing.B) { benchmarkDomainIndex(b, 100000) }
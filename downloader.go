@@ -1,47 +1,47 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"crypto/x509/pkix"
+	"database/sql"
 	"encoding/hex"
 	"encoding/pem"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/zmap/zgrab/ztools/zct"
-	"github.com/zmap/zgrab/ztools/zct/scanner"
 	"github.com/zmap/zgrab/ztools/zct/x509"
 )
 
-func processCert(entry *ct.LogEntry, cert *x509.Certificate, precert bool, server string) {
-	// TODO Do we care about the server?
-	serverName := ""
-	domain := ""
-	if len(cert.DNSNames) > 0 {
-		domain = cert.DNSNames[0]
-	} else if len(cert.PermittedDNSDomains) > 0 {
-		domain = cert.PermittedDNSDomains[0]
-	}
-
-	flag := false
-
-	for _, hostname := range hostnames[server] {
-		if domain == hostname {
-			flag = true
+// processCert stores a certificate found in a log, failing if it can't be
+// stored
+func processCert(entry *ct.LogEntry, cert *x509.Certificate, precert bool, logConf LogConfig) error {
+	server := logConf.Name
+	// The scanner has already discarded anything the log's matcher didn't want,
+	// so all that's left is to work out which of our names this is for
+	reason, score := reasonWatched, 1.0
+	index := hostnames.index(server)
+	domain, watched, ok := index.matchCert(cert)
+	if !ok {
+		if hit, found := index.lookalikeCert(cert); found {
+			domain, watched, reason, score = hit.name, hit.brand, hit.reason, hit.score
+			log.Warningf("Look-alike of %s (%s, %.2f): %s", hit.brand, hit.reason, hit.score, hit.name)
+		} else if names := certNames(cert); len(names) > 0 {
+			domain = normalizeName(names[0])
 		}
 	}
 
-	// If we don't care about this cert, forget about it
-	if !flag {
-		return
-	}
-
 	intermediates := x509.NewCertPool()
+	var chain []*x509.Certificate
 	for _, interBytes := range entry.Chain {
 		if len(interBytes) < 0 {
 			continue
 		}
 		tmp, err := x509.ParseCertificate(interBytes)
 		if err != nil {
-			log.Noticef("Err parsing chain for %s:%d: %s\n", serverName, entry.Index, err)
+			log.Noticef("Err parsing chain for %s:%d: %s\n", server, entry.Index, err)
 			switch err.(type) {
 			case x509.UnhandledCriticalExtension:
 				block := pem.Block{"TRUSTED CERTIFICATE", nil, interBytes}
@@ -50,6 +50,7 @@ func processCert(entry *ct.LogEntry, cert *x509.Certificate, precert bool, serve
 			continue
 		}
 		intermediates.AddCert(tmp)
+		chain = append(chain, tmp)
 		fpArr := sha256.Sum256(tmp.Raw)
 		log.Debugf("Added intermediate: %s\n", hex.EncodeToString(fpArr[:]))
 	}
@@ -58,12 +59,12 @@ func processCert(entry *ct.LogEntry, cert *x509.Certificate, precert bool, serve
 	valid := false
 	if err == nil && len(chains) > 0 {
 		valid = true
-		log.Debugf("Valid leaf chain for %s:%d\n", serverName, entry.Index)
+		log.Debugf("Valid leaf chain for %s:%d\n", server, entry.Index)
 	} else {
 		if err == nil {
-			log.Debugf("Invalid leaf chain for %s:%d: No chains found\n", serverName, entry.Index)
+			log.Debugf("Invalid leaf chain for %s:%d: No chains found\n", server, entry.Index)
 		} else {
-			log.Debugf("Invalid leaf chain for %s:%d: %s\n", serverName, entry.Index, err.Error())
+			log.Debugf("Invalid leaf chain for %s:%d: %s\n", server, entry.Index, err.Error())
 		}
 	}
 
@@ -71,65 +72,219 @@ func processCert(entry *ct.LogEntry, cert *x509.Certificate, precert bool, serve
 	// XOR valid and precert, since we only want valid certs and also precerts
 	if valid != precert {
 		log.Debugf("Adding cert %v", domain)
-		block := pem.Block{"TRUSTED CERTIFICATE", nil, cert.Raw}
-		cert_pem := string(pem.EncodeToMemory(&block))
-		err := monitor.DB.QueryRow(
-			"INSERT INTO domains(domain, cert_pem) VALUES($1, $2)", domain, cert_pem).Scan()
-
+		w, _ := hostnames.watched(server, watched)
+		r := newRecord(entry, cert, precert, logConf)
+		r.Domain, r.Reason, r.Score, r.Valid = domain, reason, score, valid
+		r.Owner = w.Owner
+		r.Verdict = classify(w, reason, cert, chain)
+		// The alert is queued with the certificate, so one can't be stored
+		// without the other. Each notifier decides what to do with expected
+		// certificates.
+		err := r.createCertificate(monitor.DB, func(tx *sql.Tx) error {
+			if r.inserted {
+				return alerts.dispatch(tx, newAlert(&r, w.Owner))
+			}
+			return nil
+		})
 		if err != nil {
-			log.Debugf("Could not cert to database: %s", err)
+			log.Noticef("Couldn't store certificate from %s:%d: %s", server, entry.Index, err)
+			return storeError(err)
 		}
+	}
+	return nil
+}
+
+// newRecord collects what we store about a certificate found in a log
+func newRecord(entry *ct.LogEntry, cert *x509.Certificate, precert bool, logConf LogConfig) record {
+	der := cert.Raw
+	if len(der) == 0 && precert {
+		der = entry.Leaf.TimestampedEntry.PrecertEntry.TBSCertificate
+	}
+	block := pem.Block{Type: "TRUSTED CERTIFICATE", Bytes: der}
+	fingerprint := sha256.Sum256(der)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	serial := ""
+	if cert.SerialNumber != nil {
+		serial = hex.EncodeToString(cert.SerialNumber.Bytes())
+	}
 
+	names := make([]string, 0, len(cert.DNSNames)+1)
+	seen := make(map[string]bool)
+	for _, name := range certNames(cert) {
+		name = normalizeName(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	tbs := cert.RawTBSCertificate
+	if precert {
+		tbs = entry.Leaf.TimestampedEntry.PrecertEntry.TBSCertificate
+	}
+	tbsHash, err := issuanceHash(tbs)
+	if err != nil {
+		log.Noticef("Err hashing TBSCertificate for %s:%d: %s\n", logConf.Name, entry.Index, err)
+	}
+
+	var chain []byte
+	for _, der := range entry.Chain {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	timestamp := int64(entry.Leaf.TimestampedEntry.Timestamp)
+	return record{
+		Names:      names,
+		Cert:       string(pem.EncodeToMemory(&block)),
+		SHA256:     hex.EncodeToString(fingerprint[:]),
+		TBSSHA256:  tbsHash,
+		Serial:     serial,
+		Issuer:     distinguishedName(cert.Issuer),
+		Subject:    distinguishedName(cert.Subject),
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		SPKISHA256: hex.EncodeToString(spki[:]),
+		CTServer:   logConf.Name,
+		Precert:    precert,
+		chain:      string(chain),
+		Sightings: []sighting{{
+			CTServer:     logConf.Name,
+			LogURL:       logConf.Url,
+			LogIndex:     entry.Index,
+			SCTTimestamp: time.Unix(timestamp/1000, (timestamp%1000)*int64(time.Millisecond)).UTC(),
+			Precert:      precert,
+			SHA256:       hex.EncodeToString(fingerprint[:]),
+		}},
 	}
 }
 
-func foundCert(entry *ct.LogEntry, server string) {
-	processCert(entry, entry.X509Cert, false, server)
+// distinguishedName formats a name in the usual "CN=..., O=..., C=..." form
+func distinguishedName(name pkix.Name) string {
+	var parts []string
+	add := func(key string, values ...string) {
+		for _, value := range values {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	add("CN", name.CommonName)
+	add("OU", name.OrganizationalUnit...)
+	add("O", name.Organization...)
+	add("L", name.Locality...)
+	add("ST", name.Province...)
+	add("C", name.Country...)
+	if name.CommonName == "" {
+		parts = parts[1:]
+	}
+	return strings.Join(parts, ", ")
 }
 
-func foundPrecert(entry *ct.LogEntry, server string) {
-	precert := entry.Precert.TBSCertificate
-	processCert(entry, &precert, true, server)
+// matchEntry makes the function a scan processes each entry of a log with:
+// it parses the certificate or precertificate and stores it if matcher wants
+// it. An entry that can't be parsed never will be, so it is skipped.
+func matchEntry(logConf LogConfig, matcher Matcher) func(*ct.LogEntry) error {
+	return func(entry *ct.LogEntry) error {
+		leaf := entry.Leaf.TimestampedEntry
+		switch leaf.EntryType {
+		case ct.X509LogEntryType:
+			cert, err := x509.ParseCertificate(leaf.X509Entry)
+			if err != nil {
+				return permanent(err)
+			}
+			entry.X509Cert = cert
+			if !matcher.Match(cert) {
+				return nil
+			}
+			return processCert(entry, cert, false, logConf)
+		case ct.PrecertLogEntryType:
+			tbs, err := x509.ParseTBSCertificate(leaf.PrecertEntry.TBSCertificate)
+			if err != nil {
+				return permanent(err)
+			}
+			entry.Precert = &ct.Precertificate{
+				Raw:            leaf.PrecertEntry.TBSCertificate,
+				IssuerKeyHash:  leaf.PrecertEntry.IssuerKeyHash,
+				TBSCertificate: *tbs,
+			}
+			if !matcher.Match(tbs) {
+				return nil
+			}
+			return processCert(entry, tbs, true, logConf)
+		}
+		return nil
+	}
+}
+
+// storeError marks an error storing a certificate as permanent if the data
+// itself was refused, rather than the database being unavailable
+func storeError(err error) error {
+	if e, ok := err.(*pq.Error); ok && (e.Code.Class() == "22" || e.Code.Class() == "23") {
+		return permanent(err)
+	}
+	return err
+}
+
+// How long a downloader waits between scans of its log
+const scanInterval = 5 * time.Minute
+
+// caughtUpWith says if a log has been scanned to the end of its tree, or to
+// where its configuration says to stop. LastIndex is the first entry not yet
+// processed.
+func caughtUpWith(conf LogConfig, treeSize int64) bool {
+	return conf.LastIndex >= treeSize || (conf.MaximumIndex > 0 && conf.LastIndex >= conf.MaximumIndex)
 }
 
-func downloader(logConf LogConfig, logUpdater chan LogConfig, done chan bool, rootFile string, numFetch, numMatch int) {
+// downloader follows a log, scanning it every scanInterval until ctx is
+// cancelled or, with -exit, until it has caught up. Its progress is sent to
+// logUpdater, last of all where it stopped, which it also returns.
+func downloader(ctx context.Context, logConf LogConfig, matcher Matcher, logUpdater chan LogConfig, numFetch, numMatch int) LogConfig {
 	for {
 		log.Debug("Downloading ", logConf.Name)
-		logServerConnection := NewWithOffset(logConf.Url, logConf.BucketSize, logConf.LastIndex)
-		if logServerConnection == nil {
-			return
-		}
-		scanOpts := scanner.ScannerOptions{
-			Matcher:       &scanner.MatchAll{},
-			PrecertOnly:   false,
-			BatchSize:     logConf.BucketSize,
-			NumWorkers:    numMatch,
-			ParallelFetch: numFetch,
-			StartIndex:    logConf.LastIndex,
-			Quiet:         false,
-			Name:          logConf.Name,
-			MaximumIndex:  logConf.MaximumIndex,
-		}
-		s := scanner.NewScanner(logServerConnection.logClient, scanOpts, log)
-		updater := make(chan int64)
-		// Update the log file
-		go func() {
-			for {
-				update := <-updater
-				logConf.LastIndex = update
+		logServerConnection := NewWithOffset(ctx, logConf.Url, logConf.BucketSize, logConf.LastIndex)
+		if logServerConnection != nil {
+			s := logScan{
+				name:      logConf.Name,
+				client:    logServerConnection.logClient,
+				start:     logConf.LastIndex,
+				end:       logServerConnection.treeSize,
+				batchSize: logConf.BucketSize,
+				numFetch:  numFetch,
+				numMatch:  numMatch,
+				process:   matchEntry(logConf, matcher),
+			}
+			if logConf.MaximumIndex > 0 && logConf.MaximumIndex < s.end {
+				s.end = logConf.MaximumIndex
+			}
+			backfills.fetching(logConf.Name, s.end)
+			// Record progress in the log file as we go
+			delta, err := scanLog(ctx, s, func(index int64) {
+				logConf.LastIndex = index
+				logUpdater <- logConf
+			})
+
+			logConf.LastIndex = delta
+			if ctx.Err() != nil {
+				log.Noticef("%s stopped at index %d", logConf.Name, logConf.LastIndex)
 				logUpdater <- logConf
+				return logConf
 			}
-		}()
+			if err != nil {
+				log.Notice("Scan failed ", err)
+			}
+			log.Noticef("%s now at index %d", logConf.Name, logConf.LastIndex)
+			logUpdater <- logConf
 
-		delta, err := s.Scan(foundCert, foundPrecert, updater)
+			if exit && err == nil && caughtUpWith(logConf, logServerConnection.treeSize) {
+				log.Noticef("%s has caught up with its tree head", logConf.Name)
+				return logConf
+			}
+		} else if ctx.Err() == nil {
+			log.Noticef("Couldn't connect to %s, retrying in %s", logConf.Name, scanInterval)
+		}
 
-		if err != nil {
-			log.Notice("Scan failed ", err)
-		} else {
-			logConf.LastIndex = delta
+		select {
+		case <-ctx.Done():
+			return logConf
+		case <-time.After(scanInterval):
 		}
-		log.Noticef("%s now at index %d", logConf.Name, logConf.LastIndex)
-		logUpdater <- logConf
-		time.Sleep(time.Minute * 5)
 	}
 }
@@ -0,0 +1,294 @@
+// email.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// ErrNoStartTLS if a mail server that must use STARTTLS doesn't offer it
+var ErrNoStartTLS = errors.New("Error mail server doesn't support STARTTLS")
+
+// Digest schedules
+const (
+	digestNone   = ""
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+// Most alerts put in one digest
+const maxDigest = 500
+
+// emailConfig is a mail server alerts are sent through. Violations are mailed
+// right away; with a Digest of "daily" or "weekly" expected certificates are
+// collected into one message per owner, sent at midnight UTC (on Mondays for
+// weekly), and without one they aren't mailed.
+type emailConfig struct {
+	Name     string `json:"name"`
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Refuse to send unless the server offers STARTTLS
+	StartTLS bool     `json:"starttls"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// Addresses for the alerts of each owner, instead of To
+	Recipients map[string][]string `json:"recipients"`
+	Digest     string              `json:"digest"`
+	// Files replacing the default "subject" and "body" templates
+	Template       string `json:"template"`
+	DigestTemplate string `json:"digest_template"`
+	alertRoute
+}
+
+type emailNotifier struct {
+	emailConfig
+	alert, digest *template.Template
+}
+
+// Shared by every email template
+const detailsTemplate = `{{define "details"}}Names:      {{join .Names ", "}}
+Issuer:     {{.Issuer}}
+Serial:     {{.Serial}}
+SHA-256:    {{.SHA256}}
+Not before: {{date .NotBefore}}
+Not after:  {{date .NotAfter}}
+Log:        {{.CTServer}} ({{.LogURL}}) entry {{.LogIndex}}
+Precert:    {{.Precert}}
+Valid:      {{.Valid}}
+crt.sh:     https://crt.sh/?sha256={{.SHA256}}
+{{end}}`
+
+const alertTemplate = `{{define "subject"}}Certificate for {{.Domain}} ({{.Reason}}){{end}}
+{{define "body"}}A certificate was logged for {{.Domain}}{{if ne .Reason "watched"}}, a {{.Reason}} look-alike of a watched domain (score {{printf "%.2f" .Score}}){{end}}{{if .Owner}}, owned by {{.Owner}}{{end}}.
+
+{{template "details" .}}
+{{.Cert}}{{end}}`
+
+const digestTemplate = `{{define "subject"}}{{len .Alerts}} certificates for {{if .Owner}}{{.Owner}}{{else}}watched domains{{end}}{{end}}
+{{define "body"}}{{len .Alerts}} certificates were logged for {{if .Owner}}domains owned by {{.Owner}}{{else}}watched domains{{end}} since the last digest.
+{{range .Alerts}}
+{{.Domain}} ({{.Reason}})
+{{template "details" .}}{{end}}{{end}}`
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"date": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 MST") },
+}
+
+// digestData is what a digest template is executed with
+type digestData struct {
+	Owner  string
+	Alerts []alert
+}
+
+func newEmailNotifier(conf emailConfig) (*emailNotifier, error) {
+	if conf.Digest != digestNone && conf.Digest != digestDaily && conf.Digest != digestWeekly {
+		return nil, fmt.Errorf("email %s: unknown digest %q", conf.Name, conf.Digest)
+	}
+	n := &emailNotifier{emailConfig: conf}
+	var err error
+	if n.alert, err = parseEmailTemplate(alertTemplate, conf.Template); err != nil {
+		return nil, err
+	}
+	if n.digest, err = parseEmailTemplate(digestTemplate, conf.DigestTemplate); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// parseEmailTemplate reads a template from filename, or uses the default
+func parseEmailTemplate(text, filename string) (*template.Template, error) {
+	if filename != "" {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		text = string(contents)
+	}
+	tmpl, err := template.New("").Funcs(templateFuncs).Parse(detailsTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Parse(text)
+}
+
+func (n *emailNotifier) Name() string {
+	return "email:" + n.emailConfig.Name
+}
+
+func (n *emailNotifier) Wants(a *alert) bool {
+	if n.Digest == digestNone && !n.urgent(a) {
+		return false
+	}
+	return n.wants(a) && len(n.recipients(a.Owner)) > 0
+}
+
+func (n *emailNotifier) MaxBatch() int {
+	return maxDigest
+}
+
+// Due holds back all but urgent alerts until the next digest
+func (n *emailNotifier) Due(a *alert, now time.Time) time.Time {
+	if n.Digest == digestNone || n.urgent(a) {
+		return now
+	}
+	next := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	if n.Digest == digestWeekly {
+		for next.Weekday() != time.Monday {
+			next = next.Add(24 * time.Hour)
+		}
+	}
+	return next
+}
+
+// urgent reports whether an alert is mailed without waiting for a digest
+func (n *emailNotifier) urgent(a *alert) bool {
+	return a.Verdict != verdictExpected
+}
+
+func (n *emailNotifier) recipients(owner string) []string {
+	if to, ok := n.Recipients[owner]; ok && owner != "" {
+		return to
+	}
+	return n.To
+}
+
+// Split puts each urgent alert in a message of its own, followed by one digest
+// per owner for the rest
+func (n *emailNotifier) Split(alerts []alert) [][]alert {
+	var messages [][]alert
+	var owners []string
+	digests := make(map[string][]alert)
+	for _, a := range alerts {
+		if n.Digest == digestNone || n.urgent(&a) {
+			messages = append(messages, []alert{a})
+			continue
+		}
+		if _, ok := digests[a.Owner]; !ok {
+			owners = append(owners, a.Owner)
+		}
+		digests[a.Owner] = append(digests[a.Owner], a)
+	}
+	for _, owner := range owners {
+		messages = append(messages, digests[owner])
+	}
+	return messages
+}
+
+// Deliver mails urgent alerts one at a time and the rest as one digest per
+// owner
+func (n *emailNotifier) Deliver(alerts []alert) error {
+	for _, message := range n.Split(alerts) {
+		a := message[0]
+		var err error
+		if n.Digest == digestNone || n.urgent(&a) {
+			err = n.send(n.recipients(a.Owner), n.alert, a)
+		} else {
+			err = n.send(n.recipients(a.Owner), n.digest, digestData{a.Owner, message})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send renders a message and hands it to the mail server
+func (n *emailNotifier) send(to []string, tmpl *template.Template, data interface{}) error {
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", encodeSubject(subject.String()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(strings.TrimSpace(body.String()), "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+
+	return n.sendMail(to, msg.Bytes())
+}
+
+// encodeSubject makes a rendered subject safe for the header: the names in it
+// come from certificates, so line breaks and other control characters are
+// replaced, and anything not ASCII is sent as an RFC 2047 encoded word
+func encodeSubject(subject string) string {
+	subject = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, subject)
+	return mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject))
+}
+
+// sendMail is smtp.SendMail with STARTTLS made mandatory if configured
+func (n *emailNotifier) sendMail(to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(n.Server)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", n.Server, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	} else if n.StartTLS {
+		return ErrNoStartTLS
+	}
+	if n.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
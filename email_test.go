@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts mail on a local port and hands each message it receives to
+// the returned channel
+func fakeSMTP(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s", err)
+	}
+	messages := make(chan string, 10)
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func serveSMTP(conn net.Conn, messages chan string) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ready")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch verb := strings.ToUpper(strings.Fields(line + " ")[0]); verb {
+		case "EHLO":
+			tp.PrintfLine("250 localhost")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			body, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			messages <- string(body)
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func TestEmailDeliver(t *testing.T) {
+	addr, messages := fakeSMTP(t)
+	n, err := newEmailNotifier(emailConfig{
+		Name:       "security",
+		Server:     addr,
+		From:       "monitor@example.com",
+		To:         []string{"security@example.com"},
+		Recipients: map[string][]string{"web": {"web@example.com"}},
+		Digest:     digestDaily,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create notifier: %s", err)
+	}
+
+	batch := []alert{
+		{Domain: "mbernhard.com", Owner: "web", Reason: reasonWatched, Verdict: verdictExpected, SHA256: "ab12",
+			Cert: "-----BEGIN TRUSTED CERTIFICATE-----"},
+		{Domain: "www.mbernhard.com", Owner: "web", Reason: reasonWatched, Verdict: verdictExpected},
+		{Domain: "mbernhart.com", Reason: reasonTypo, Score: 0.9, Verdict: verdictViolation},
+	}
+	if err := n.Deliver(batch); err != nil {
+		t.Fatalf("Unexpected error delivering: %s", err)
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			got = append(got, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 messages, got %d", len(got))
+		}
+	}
+	urgent, digest := got[0], got[1]
+	if !strings.Contains(urgent, "To: security@example.com") || !strings.Contains(urgent, "mbernhart.com (typo)") {
+		t.Errorf("Expected an immediate look-alike alert to security, got %s", urgent)
+	}
+	if !strings.Contains(digest, "To: web@example.com") || !strings.Contains(digest, "Subject: 2 certificates for web") {
+		t.Errorf("Expected a digest of 2 certificates to web, got %s", digest)
+	}
+	if !strings.Contains(digest, "https://crt.sh/?sha256=ab12") {
+		t.Errorf("Expected crt.sh details in the digest, got %s", digest)
+	}
+}
+
+func TestEmailSplit(t *testing.T) {
+	n := &emailNotifier{emailConfig: emailConfig{Digest: digestDaily}}
+	batch := []alert{
+		{ID: 1, Owner: "web", Verdict: verdictExpected},
+		{ID: 2, Reason: reasonTypo, Verdict: verdictViolation},
+		{ID: 3, Owner: "mail", Verdict: verdictExpected},
+		{ID: 4, Owner: "web", Verdict: verdictExpected},
+	}
+	var got [][]int64
+	for _, message := range n.Split(batch) {
+		got = append(got, alertIDs(message))
+	}
+	if len(got) != 3 || len(got[0]) != 1 || got[0][0] != 2 ||
+		len(got[1]) != 2 || got[1][1] != 4 || len(got[2]) != 1 || got[2][0] != 3 {
+		t.Errorf("Expected the look-alike alone, then a digest per owner, got %v", got)
+	}
+}
+
+func TestEmailSubjectInjection(t *testing.T) {
+	addr, messages := fakeSMTP(t)
+	n, err := newEmailNotifier(emailConfig{Name: "security", Server: addr, From: "monitor@example.com", To: []string{"security@example.com"}})
+	if err != nil {
+		t.Fatalf("Couldn't create notifier: %s", err)
+	}
+	if err := n.Deliver([]alert{{Domain: "mbernhard.com\r\nBcc: evil@example.com", Reason: reasonWatched}}); err != nil {
+		t.Fatalf("Unexpected error delivering: %s", err)
+	}
+	select {
+	case msg := <-messages:
+		header := strings.SplitN(msg, "\n\n", 2)[0]
+		for _, line := range strings.Split(header, "\n") {
+			if strings.HasPrefix(line, "Bcc:") {
+				t.Errorf("Expected the name to stay in the subject, got %s", msg)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a message")
+	}
+
+	if s := encodeSubject("Certificate for bücher.example"); s != "=?utf-8?q?Certificate_for_b=C3=BCcher.example?=" {
+		t.Errorf("Expected the subject as an encoded word, got %s", s)
+	}
+}
+
+func TestEmailRequireStartTLS(t *testing.T) {
+	addr, _ := fakeSMTP(t)
+	n, err := newEmailNotifier(emailConfig{Name: "tls", Server: addr, StartTLS: true, To: []string{"a@example.com"}})
+	if err != nil {
+		t.Fatalf("Couldn't create notifier: %s", err)
+	}
+	if err := n.Deliver([]alert{{Domain: "mbernhard.com"}}); err != ErrNoStartTLS {
+		t.Errorf("Expected %s, got %v", ErrNoStartTLS, err)
+	}
+}
+
+func TestEmailDue(t *testing.T) {
+	n := &emailNotifier{emailConfig: emailConfig{Digest: digestWeekly}}
+	// A Wednesday
+	now := time.Date(2018, 3, 14, 15, 0, 0, 0, time.UTC)
+	monday := time.Date(2018, 3, 19, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		a   alert
+		due time.Time
+	}{
+		{alert{Reason: reasonWatched, Verdict: verdictExpected}, monday},
+		{alert{Reason: reasonWatched, Verdict: verdictViolation}, now},
+		{alert{Reason: reasonHomoglyph, Verdict: verdictViolation}, now},
+	}
+	for _, c := range cases {
+		if due := n.Due(&c.a, now); !due.Equal(c.due) {
+			t.Errorf("%v: expected due %s, got %s", c.a, c.due, due)
+		}
+	}
+
+	n.Digest = digestDaily
+	if due := n.Due(&cases[0].a, now); !due.Equal(time.Date(2018, 3, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the next daily digest at midnight, got %s", due)
+	}
+}
+
+func TestEmailWants(t *testing.T) {
+	n := &emailNotifier{emailConfig: emailConfig{To: []string{"security@example.com"}}}
+	expected := &alert{Verdict: verdictExpected}
+	violation := &alert{Verdict: verdictViolation}
+	if n.Wants(expected) || !n.Wants(violation) {
+		t.Errorf("Expected only violations mailed without a digest")
+	}
+	n.Digest = digestDaily
+	if !n.Wants(expected) || !n.Wants(violation) {
+		t.Errorf("Expected expected certificates mailed in the digest")
+	}
+}
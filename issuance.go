@@ -0,0 +1,85 @@
+// issuance.go
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+)
+
+// ErrTBSCertificate if a TBSCertificate can't be taken apart
+var ErrTBSCertificate = errors.New("Error malformed TBSCertificate")
+
+var (
+	// Marks a precertificate so it can't be used as a certificate (RFC 6962 3.1)
+	oidCTPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	// The SCTs embedded in a final certificate (RFC 6962 3.3)
+	oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// issuanceHash returns the hex SHA-256 of a TBSCertificate with the CT poison
+// and SCT list extensions removed, which is the same for a precertificate and
+// the final certificate issued from it.
+func issuanceHash(tbs []byte) (string, error) {
+	var outer asn1.RawValue
+	if rest, err := asn1.Unmarshal(tbs, &outer); err != nil || len(rest) > 0 {
+		return "", ErrTBSCertificate
+	}
+
+	var fields []byte
+	for rest := outer.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &field); err != nil {
+			return "", ErrTBSCertificate
+		}
+		if field.Class == asn1.ClassContextSpecific && field.Tag == 3 {
+			extensions, err := stripCTExtensions(field.Bytes)
+			if err != nil {
+				return "", err
+			}
+			field = asn1.RawValue{Class: field.Class, Tag: field.Tag, IsCompound: true, Bytes: extensions}
+			if field.FullBytes, err = asn1.Marshal(field); err != nil {
+				return "", err
+			}
+		}
+		fields = append(fields, field.FullBytes...)
+	}
+
+	normalized, err := asn1.Marshal(asn1.RawValue{Class: outer.Class, Tag: outer.Tag, IsCompound: true, Bytes: fields})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(normalized)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// stripCTExtensions re-encodes the [3] Extensions field without the CT poison
+// and SCT list extensions
+func stripCTExtensions(explicit []byte) ([]byte, error) {
+	var seq asn1.RawValue
+	if rest, err := asn1.Unmarshal(explicit, &seq); err != nil || len(rest) > 0 {
+		return nil, ErrTBSCertificate
+	}
+
+	var kept []byte
+	for rest := seq.Bytes; len(rest) > 0; {
+		var extension asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &extension); err != nil {
+			return nil, ErrTBSCertificate
+		}
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(extension.Bytes, &oid); err != nil {
+			return nil, ErrTBSCertificate
+		}
+		if oid.Equal(oidCTPoison) || oid.Equal(oidSCTList) {
+			continue
+		}
+		kept = append(kept, extension.FullBytes...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Class: seq.Class, Tag: seq.Tag, IsCompound: true, Bytes: kept})
+}
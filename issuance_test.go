@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestIssuanceHash(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "mbernhard.com"},
+		DNSNames:     []string{"mbernhard.com", "www.mbernhard.com"},
+		NotBefore:    time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+	}
+	issue := func(extensions ...pkix.Extension) []byte {
+		tmpl := template
+		tmpl.ExtraExtensions = extensions
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.RawTBSCertificate
+	}
+
+	sctList, _ := asn1.Marshal([]byte{0, 0})
+	poison := pkix.Extension{Id: oidCTPoison, Critical: true, Value: asn1.NullBytes}
+	sct := pkix.Extension{Id: oidSCTList, Value: sctList}
+
+	precert, err := issuanceHash(issue(poison))
+	if err != nil {
+		t.Fatalf("Couldn't hash precertificate: %s", err)
+	}
+	final, err := issuanceHash(issue(sct))
+	if err != nil {
+		t.Fatalf("Couldn't hash certificate: %s", err)
+	}
+	if precert != final {
+		t.Errorf("Expected precertificate and certificate to hash the same, got %s and %s", precert, final)
+	}
+
+	template.SerialNumber = big.NewInt(43)
+	other, _ := issuanceHash(issue(sct))
+	if other == final {
+		t.Errorf("Expected a different serial to hash differently")
+	}
+
+	if _, err := issuanceHash([]byte("garbage")); err == nil {
+		t.Errorf("Expected an error hashing garbage")
+	}
+}
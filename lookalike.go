@@ -0,0 +1,374 @@
+// lookalike.go
+
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+	"golang.org/x/net/idna"
+)
+
+// Reasons a certificate was stored
+const (
+	reasonWatched   = "watched"
+	reasonTypo      = "typo"
+	reasonHomoglyph = "homoglyph"
+	reasonTLDSwap   = "tld-swap"
+	reasonKeyword   = "keyword"
+)
+
+// Whether to look for certificates resembling our domains, and the maximum
+// edit distance at which a name counts as a typo of one of ours
+var (
+	lookalikeMode     bool
+	lookalikeDistance = 1
+)
+
+// Brands shorter than this are too likely to turn up by chance inside
+// unrelated names to be used as keywords
+const minKeywordLength = 4
+
+// Characters that render (nearly) identically to an ASCII letter
+var confusables = map[rune]string{
+	'а': "a", 'в': "b", 'с': "c", 'ԁ': "d", 'е': "e", 'һ': "h", 'і': "i", 'ј': "j",
+	'к': "k", 'ӏ': "l", 'м': "m", 'п': "n", 'о': "o", 'р': "p", 'ԛ': "q", 'г': "r",
+	'ѕ': "s", 'т': "t", 'ц': "u", 'ѵ': "v", 'ԝ': "w", 'х': "x", 'у': "y", 'з': "3",
+	'α': "a", 'β': "b", 'ε': "e", 'η': "n", 'ι': "i", 'κ': "k", 'ν': "v", 'ο': "o",
+	'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'ɡ': "g", 'ı': "i", 'ł': "l", 'ø': "o",
+	'0': "o", '1': "l", '|': "l",
+}
+
+// ASCII sequences that read as a single letter at a glance
+var confusableSequences = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+// Second-level labels commonly used under country-code TLDs
+var secondLevels = map[string]bool{
+	"co": true, "com": true, "net": true, "org": true, "ac": true, "gov": true, "edu": true,
+}
+
+// lookalike describes why a name resembles one of ours
+type lookalike struct {
+	name   string
+	brand  string
+	reason string
+	score  float64
+}
+
+// brand is the distinctive label of a watched domain, e.g. "mbernhard" in
+// "mail.mbernhard.com"
+type brand struct {
+	domain string
+	label  string
+	suffix string
+}
+
+// brandIndex finds watched domains that a name is confusingly similar to.
+// Typos are found through the deletion neighbourhood of each brand, so a
+// lookup costs the same however many domains are watched. Like domainIndex
+// it is persistent, and adding a domain only builds its own neighbourhood.
+type brandIndex struct {
+	distance int
+	// Each of these maps to the []*brand with that label, skeleton or
+	// deletion of the label
+	byLabel    *pmap
+	bySkeleton *pmap
+	byDeletion *pmap
+	// The watched domains behind each brand, by brandKey, the first being the
+	// one reported
+	domains *pmap
+	// How many brands have labels of each length
+	lengths map[int]int
+}
+
+func newBrandIndex(distance int) *brandIndex {
+	return &brandIndex{distance: distance, lengths: make(map[int]int)}
+}
+
+func brandKey(label, suffix string) string {
+	return label + "/" + suffix
+}
+
+// brands returns the brands under key in one of the index's maps
+func brands(m *pmap, key string) []*brand {
+	if v, ok := m.get(key); ok {
+		return v.([]*brand)
+	}
+	return nil
+}
+
+// splitDomain splits a name into its registrable label and public suffix,
+// using a rough heuristic in place of the public suffix list
+func splitDomain(name string) (string, string) {
+	labels := strings.Split(name, ".")
+	n := len(labels)
+	switch {
+	case n == 1:
+		return name, ""
+	case n >= 3 && len(labels[n-1]) == 2 && secondLevels[labels[n-2]]:
+		return labels[n-3], labels[n-2] + "." + labels[n-1]
+	default:
+		return labels[n-2], labels[n-1]
+	}
+}
+
+// with returns the index with domain watched as well
+func (idx *brandIndex) with(domain string) *brandIndex {
+	label, suffix := splitDomain(domain)
+	if label == "" {
+		return idx
+	}
+	key := brandKey(label, suffix)
+	var domains []string
+	if v, ok := idx.domains.get(key); ok {
+		domains = v.([]string)
+	}
+	next := *idx
+	next.domains = idx.domains.with(key, append(append([]string(nil), domains...), domain))
+	if len(domains) == 0 {
+		next.insert(&brand{domain, label, suffix})
+	}
+	return &next
+}
+
+// without returns the index with domain no longer watched. A brand stays as
+// long as any domain behind it is watched.
+func (idx *brandIndex) without(domain string) *brandIndex {
+	label, suffix := splitDomain(domain)
+	key := brandKey(label, suffix)
+	v, ok := idx.domains.get(key)
+	if !ok {
+		return idx
+	}
+	domains := v.([]string)
+	remaining := make([]string, 0, len(domains))
+	for i, d := range domains {
+		if d == domain {
+			remaining = append(remaining, domains[i+1:]...)
+			break
+		}
+		remaining = append(remaining, d)
+	}
+	if len(remaining) == len(domains) {
+		return idx
+	}
+
+	next := *idx
+	if len(remaining) == 0 {
+		next.domains = idx.domains.without(key)
+		next.drop(label, suffix)
+		return &next
+	}
+	next.domains = idx.domains.with(key, remaining)
+	if remaining[0] != domains[0] {
+		next.drop(label, suffix)
+		next.insert(&brand{remaining[0], label, suffix})
+	}
+	return &next
+}
+
+// insert adds a brand to the maps of an index that isn't yet published
+func (idx *brandIndex) insert(b *brand) {
+	add := func(m *pmap, key string) *pmap {
+		return m.with(key, append(append([]*brand(nil), brands(m, key)...), b))
+	}
+	idx.byLabel = add(idx.byLabel, b.label)
+	idx.bySkeleton = add(idx.bySkeleton, confusableSkeleton(b.label))
+	for _, deletion := range deletions(b.label, idx.distance) {
+		idx.byDeletion = add(idx.byDeletion, deletion)
+	}
+	idx.lengths = copyLengths(idx.lengths)
+	idx.lengths[utf8.RuneCountInString(b.label)]++
+}
+
+// drop removes a brand from the maps of an index that isn't yet published
+func (idx *brandIndex) drop(label, suffix string) {
+	remove := func(m *pmap, key string) *pmap {
+		var kept []*brand
+		for _, b := range brands(m, key) {
+			if b.label != label || b.suffix != suffix {
+				kept = append(kept, b)
+			}
+		}
+		if len(kept) == 0 {
+			return m.without(key)
+		}
+		return m.with(key, kept)
+	}
+	idx.byLabel = remove(idx.byLabel, label)
+	idx.bySkeleton = remove(idx.bySkeleton, confusableSkeleton(label))
+	for _, deletion := range deletions(label, idx.distance) {
+		idx.byDeletion = remove(idx.byDeletion, deletion)
+	}
+	idx.lengths = copyLengths(idx.lengths)
+	length := utf8.RuneCountInString(label)
+	if idx.lengths[length]--; idx.lengths[length] == 0 {
+		delete(idx.lengths, length)
+	}
+}
+
+// copyLengths copies the few label lengths of an index before changing them
+func copyLengths(lengths map[int]int) map[int]int {
+	next := make(map[int]int, len(lengths)+1)
+	for length, count := range lengths {
+		next[length] = count
+	}
+	return next
+}
+
+// check returns the strongest resemblance between name and a watched domain
+func (idx *brandIndex) check(name string) (lookalike, bool) {
+	if idx == nil {
+		return lookalike{}, false
+	}
+	name = strings.TrimPrefix(normalizeName(name), "*.")
+	display := toUnicode(name)
+	label, suffix := splitDomain(display)
+
+	best := lookalike{}
+	consider := func(b *brand, reason string, score float64) {
+		if score > best.score {
+			best = lookalike{name, b.domain, reason, score}
+		}
+	}
+
+	for _, b := range brands(idx.byLabel, label) {
+		if b.suffix != suffix {
+			consider(b, reasonTLDSwap, 1)
+		}
+	}
+	for _, b := range brands(idx.bySkeleton, confusableSkeleton(label)) {
+		if b.label != label {
+			consider(b, reasonHomoglyph, 1)
+		}
+	}
+	for _, deletion := range deletions(label, idx.distance) {
+		for _, b := range brands(idx.byDeletion, deletion) {
+			d := levenshtein(label, b.label)
+			if d > 0 && d <= idx.distance {
+				consider(b, reasonTypo, similarity(d, label, b.label))
+			}
+		}
+	}
+	for _, part := range strings.Split(display, ".") {
+		runes := []rune(part)
+		for length := range idx.lengths {
+			if length < minKeywordLength || length > len(runes) {
+				continue
+			}
+			for i := 0; i+length <= len(runes); i++ {
+				for _, b := range brands(idx.byLabel, string(runes[i:i+length])) {
+					if part != label || b.label != label {
+						consider(b, reasonKeyword, float64(length)/float64(len(runes)))
+					}
+				}
+			}
+		}
+	}
+
+	return best, best.score > 0
+}
+
+// checkCert returns the strongest resemblance between any name on the
+// certificate and a watched domain
+func (idx *brandIndex) checkCert(cert *x509.Certificate) (lookalike, bool) {
+	best := lookalike{}
+	for _, name := range certNames(cert) {
+		if hit, ok := idx.check(name); ok && hit.score > best.score {
+			best = hit
+		}
+	}
+	return best, best.score > 0
+}
+
+// confusableSkeleton maps a label to the ASCII string it is likely to be
+// mistaken for
+func confusableSkeleton(label string) string {
+	mapped := make([]string, 0, len(label))
+	for _, r := range label {
+		if s, ok := confusables[r]; ok {
+			mapped = append(mapped, s)
+		} else {
+			mapped = append(mapped, string(r))
+		}
+	}
+	return confusableSequences.Replace(strings.Join(mapped, ""))
+}
+
+// deletions returns every string obtained by deleting up to n runes from s,
+// including s itself
+func deletions(s string, n int) []string {
+	seen := map[string]bool{s: true}
+	current := []string{s}
+	for i := 0; i < n; i++ {
+		var next []string
+		for _, c := range current {
+			runes := []rune(c)
+			for j := range runes {
+				d := string(runes[:j]) + string(runes[j+1:])
+				if !seen[d] {
+					seen[d] = true
+					next = append(next, d)
+				}
+			}
+		}
+		current = next
+	}
+	res := make([]string, 0, len(seen))
+	for d := range seen {
+		res = append(res, d)
+	}
+	return res
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// similarity turns an edit distance into a score between 0 and 1
+func similarity(distance int, a, b string) float64 {
+	longest := utf8.RuneCountInString(a)
+	if n := utf8.RuneCountInString(b); n > longest {
+		longest = n
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(distance)/float64(longest)
+}
+
+// toUnicode decodes any punycode labels in name, leaving the rest, and any
+// that fail to decode, alone
+func toUnicode(name string) string {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if decoded, err := idna.ToUnicode(label); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLookalikeCheck(t *testing.T) {
+	idx := newBrandIndex(1)
+	for _, domain := range []string{"mbernhard.com", "npp.co.th", "imsg.com"} {
+		idx = idx.with(domain)
+	}
+
+	cases := []struct {
+		name   string
+		reason string
+		brand  string
+	}{
+		{"rnbernhard.com", reasonHomoglyph, "mbernhard.com"},
+		{"xn--mbernhrd-66g.com", reasonHomoglyph, "mbernhard.com"},
+		{"mbernhard.net", reasonTLDSwap, "mbernhard.com"},
+		{"www.mbernhard.co.uk", reasonTLDSwap, "mbernhard.com"},
+		{"mbernhart.com", reasonTypo, "mbernhard.com"},
+		{"mbemhard.com", reasonHomoglyph, "mbernhard.com"},
+		{"mberhard.com", reasonTypo, "mbernhard.com"},
+		{"mbernhard-login.com", reasonKeyword, "mbernhard.com"},
+		{"mbernhard.com.evil.net", reasonKeyword, "mbernhard.com"},
+		{"*.imsg.org", reasonTLDSwap, "imsg.com"},
+		{"imsgx.example.com", reasonKeyword, "imsg.com"},
+		{"npp.co.jp", reasonTLDSwap, "npp.co.th"},
+	}
+	for _, c := range cases {
+		hit, ok := idx.check(c.name)
+		if !ok {
+			t.Errorf("Expected %s to look like %s", c.name, c.brand)
+			continue
+		}
+		if hit.reason != c.reason || hit.brand != c.brand {
+			t.Errorf("%s: expected %s of %s, got %s of %s", c.name, c.reason, c.brand, hit.reason, hit.brand)
+		}
+		if hit.score <= 0 || hit.score > 1 {
+			t.Errorf("%s: score %v out of range", c.name, hit.score)
+		}
+	}
+
+	for _, name := range []string{"mbernhard.com", "mail.mbernhard.com", "example.com", "bernhardt.org", "msg.example.com"} {
+		if hit, ok := idx.check(name); ok {
+			t.Errorf("Expected no hit for %s, got %s of %s", name, hit.reason, hit.brand)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b string
+		d    int
+	}{
+		{"mbernhard", "mbernhard", 0},
+		{"mbernhard", "mbernhadr", 2},
+		{"mbernhard", "mberhard", 1},
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+	}
+	for _, c := range cases {
+		if d := levenshtein(c.a, c.b); d != c.d {
+			t.Errorf("levenshtein(%q, %q): expected %d, got %d", c.a, c.b, c.d, d)
+		}
+	}
+}
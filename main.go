@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
 	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/op/go-logging"
@@ -17,11 +21,6 @@ var exit bool
 var roots *x509.CertPool
 var log = logging.MustGetLogger("")
 
-var hostnames map[string][]string
-
-// Buffer for newly added domains so we can catch up
-var newHostNames map[string][]string
-
 var monitor Monitor
 
 // Example format string. Everything except the message has a custom color
@@ -33,10 +32,10 @@ var format = logging.MustStringFormatter(
 
 // TODO instrument for Prometheus
 
-func initialize(rootFile, configFile, output string, logLevel int) {
+// initialize sets up logging and the root store, and calls shutdown on the
+// first SIGINT or SIGTERM. A second one exits straight away.
+func initialize(rootFile, output string, logLevel int, shutdown func()) {
 
-	hostnames = make(map[string][]string)
-	newHostNames = make(map[string][]string)
 	var f *os.File
 	if output == "-" {
 		f = os.Stderr
@@ -60,23 +59,13 @@ func initialize(rootFile, configFile, output string, logLevel int) {
 	roots = x509.NewCertPool()
 	_ = roots.AppendCertsFromPEM(bytes)
 	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGKILL)
+		c := make(chan os.Signal, 2)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		sig := <-c
-		if sig == syscall.SIGTERM || sig == syscall.SIGINT || sig == syscall.SIGKILL {
-			log.Fatal("Received a signal:", sig, ". Shutting down.")
-			for {
-				f, err := os.Open(configFile)
-				if err != nil || f != nil {
-					f.Close()
-					break
-				}
-			}
-			f.Close()
-		} else {
-			log.Notice("Received a signal:", sig, ". Ignoring.")
-		}
-		os.Exit(1)
+		log.Notice("Received a signal:", sig, ". Shutting down.")
+		shutdown()
+		sig = <-c
+		log.Fatal("Received a signal:", sig, ". Exiting without waiting.")
 	}()
 }
 
@@ -90,51 +79,150 @@ func main() {
 	numMatch := flag.Int("matcher", 1, "Number of workers assigned to parse certs from each server")
 	logLevel := flag.Int("log-level", 0, "log level")
 	ex := flag.Bool("exit", false, "Tells the program to exit once it has gotten the most recent certificates")
-	flag.Parse()
-
+	similar := flag.Bool("lookalike", false, "Also store certificates for names that look like watched hostnames")
+	distance := flag.Int("lookalike-distance", 1, "Maximum edit distance for a name to count as a typo of a watched hostname")
 	user := flag.String("user", "monitor", "User for postgres DB")
 	password := flag.String("password", "", "Password for pq")
 	dbname := flag.String("dbname", "ctdomainmonitor", "Name of pq database")
+	lookback := flag.Int64("backfill", 0, "How many entries back to scan each log for newly watched domains, 0 for the whole log")
+	numBackfill := flag.Int("backfills", 2, "Number of backfills to run at once")
+	refresh := flag.Duration("refresh", time.Minute, "How often to reload watched domains from the database")
+	schema := flag.Int("migrate", -1, "Migrate the database schema to this version and exit")
+	alertFile := flag.String("alerts", "", "Configuration file for alert notifications, none if empty")
+	noAuth := flag.Bool("no-auth", false, "Serve the API without requiring API keys")
+	keyName := flag.String("create-key", "", "Create an API key with this name, print it and exit")
+	keyRole := flag.String("key-role", roleAdmin, "Role of the key made by -create-key: read-only, watchlist-editor or admin")
+	keyTeam := flag.String("key-team", "", "Team of the key made by -create-key")
+	listen := flag.String("listen", ":8080", "Address to serve the API on")
+	tlsCert := flag.String("tls-cert", "", "Certificate file to serve the API over TLS with, reloaded on SIGHUP")
+	tlsKey := flag.String("tls-key", "", "Key file for -tls-cert")
+	clientCA := flag.String("tls-client-ca", "", "Only serve clients with a certificate from the CAs in this file")
+	readTimeout := flag.Duration("read-timeout", 15*time.Second, "Longest time to read an API request")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "Longest time to write an API response")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "Longest time to keep an idle API connection open")
+	flag.Parse()
 
-	monitor = Monitor{}
+	if *schema >= 0 {
+		db, err := openDatabase(*user, *password, *dbname)
+		if err == nil {
+			err = migrate(db, *schema)
+		}
+		if err != nil {
+			log.Fatalf("Migration error: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	monitor = Monitor{Auth: !*noAuth}
 	monitor.Initialize(*user, *password, *dbname)
 	log.Debugf("Initialized monitor, db %v", monitor.DB)
-
-	go monitor.Run(":8080")
+	if *keyName != "" {
+		k := apiKey{Name: *keyName, Role: *keyRole, Team: *keyTeam}
+		err := k.normalize()
+		if err == nil {
+			err = k.createKey(monitor.DB)
+		}
+		if err != nil {
+			log.Fatalf("Couldn't create API key: %s", err)
+		}
+		fmt.Println(k.Key)
+		os.Exit(0)
+	}
 	// change this to allow multithreading
 	runtime.GOMAXPROCS(*numProcs)
-	initialize(*rootFile, *configFile, *output, *logLevel)
+	ctx, shutdown := context.WithCancel(context.Background())
+	initialize(*rootFile, *output, *logLevel, shutdown)
 	exit = *ex
+	lookalikeMode = *similar
+	lookalikeDistance = *distance
 
 	config, err := NewConfiguration(*configFile)
-
-	for _, conf := range config {
-		hostnames[conf.Name] = conf.HostNames
-	}
 	if err != nil {
 		log.Fatalf("Configuration error: %s", err)
 	}
-	logUpdater := make(chan LogConfig)
-	done := make(chan bool)
-	finished := make(chan bool)
-	counter := 0
-
-	for _, logC := range config {
-		go downloader(logC, logUpdater, done, *rootFile, *numFetch, *numMatch)
-		counter++
+
+	logNames := make([]string, len(config))
+	for i, conf := range config {
+		logNames[i] = conf.Name
+	}
+	hostnames.setLogs(logNames)
+	if err = importHostnames(monitor.DB, config); err != nil {
+		log.Fatalf("Couldn't import hostnames: %s", err)
+	}
+	if err = hostnames.load(monitor.DB); err != nil {
+		log.Fatalf("Couldn't load watched domains: %s", err)
+	}
+	go hostnames.refresh(ctx, monitor.DB, *refresh)
+
+	backfills = newBackfiller(ctx, config, *lookback, *numBackfill, *numFetch, *numMatch)
+	if err = backfills.resume(monitor.DB); err != nil {
+		log.Fatalf("Couldn't resume backfills: %s", err)
+	}
+
+	if *alertFile != "" {
+		if alerts, err = newAlerter(monitor.DB, *alertFile); err != nil {
+			log.Fatalf("Couldn't read alert configuration: %s", err)
+		}
+	}
+
+	if runner, err = newLogRunner(ctx, config, *numFetch, *numMatch); err != nil {
+		log.Fatalf("Configuration error in %s", err)
 	}
+
+	// Everything that must finish before exiting, other than the downloaders
+	var services sync.WaitGroup
+	if alerts != nil {
+		services.Add(1)
+		go func() {
+			defer services.Done()
+			alerts.run(ctx)
+		}()
+	}
+
+	serverConf := serverConfig{
+		Addr:         *listen,
+		CertFile:     *tlsCert,
+		KeyFile:      *tlsKey,
+		ClientCAFile: *clientCA,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+	services.Add(1)
 	go func() {
-		for i := 0; i < counter; i++ {
-			<-done
+		defer services.Done()
+		if err := monitor.Run(ctx, serverConf); err != nil {
+			log.Fatalf("Monitor: %v", err)
 		}
 	}()
+
+	runner.startAll()
+	stopped := make(chan bool)
+	go func() {
+		<-ctx.Done()
+		runner.wait()
+		close(stopped)
+	}()
 	for {
 		select {
-		case <-finished:
-			if exit {
-				os.Exit(0)
+		case <-stopped:
+			// Every downloader has sent where it stopped, and it's been
+			// written out. Wait for the rest to stop too.
+			services.Wait()
+			backfills.wait()
+			monitor.DB.Close()
+			log.Notice("Shut down")
+			return
+		case name := <-runner.idle:
+			// A log stopped through the API won't catch up, so with -exit
+			// it counts as done too
+			if exit && !runner.anyRunning() {
+				log.Noticef("%s was the last log being scanned, exiting", name)
+				shutdown()
 			}
-		case update := <-logUpdater:
+		case update := <-runner.updates:
+			runner.update(update)
+			backfills.update(update)
 			for i, conf := range config {
 				if conf.Url == update.Url {
 					config[i] = update
@@ -5,11 +5,12 @@ package main_test
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/umbernhard/ct-domain-monitor"
@@ -17,14 +18,14 @@ import (
 
 var a main.Monitor
 
-func ensureTableExists() {
-	if _, err := a.DB.Exec(tableCreationQuery); err != nil {
-		log.Fatal(err)
-	}
-}
-
 func clearTable() {
-	a.DB.Exec("DELETE FROM domains")
+	a.DB.Exec("DELETE FROM certificates")
+	a.DB.Exec("DELETE FROM watched_domains")
+	a.DB.Exec("DELETE FROM backfills")
+	a.DB.Exec("DELETE FROM alert_outbox")
+	a.DB.Exec("DELETE FROM acknowledged_certificates")
+	a.DB.Exec("DELETE FROM api_keys")
+	a.DB.Exec("DELETE FROM audit_log")
 }
 
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
@@ -46,14 +47,28 @@ func addRecords(count int) {
 	}
 
 	for i := 1; i <= count; i++ {
-		a.DB.Exec("INSERT INTO domains(domain, cert_pem) VALUES($1, $2)", strconv.Itoa(i)+".com", testPEM)
+		var id int64
+		domain := strconv.Itoa(i) + ".com"
+		a.DB.QueryRow(
+			`INSERT INTO certificates(domain, cert_pem, sha256, tbs_sha256, serial, issuer,
+				subject, not_before, not_after, spki_sha256, precert, valid)
+			VALUES($1, $2, $3, $3, $4, 'CN=Test CA', 'CN=' || $1, now(),
+				now() + interval '90 days', $3, false, true)
+			RETURNING id`,
+			domain, testPEM, fmt.Sprintf("%064x", i), fmt.Sprintf("%x", i)).Scan(&id)
+		a.DB.Exec("INSERT INTO certificate_names(certificate_id, name) VALUES($1, $2)", id, domain)
+		a.DB.Exec(
+			`INSERT INTO certificate_sightings(certificate_id, log_name, log_url, log_index,
+				sct_timestamp, precert, sha256)
+			VALUES($1, 'testtube', 'https://ct.googleapis.com/testtube', $2, now(), false, $3)`,
+			id, i, fmt.Sprintf("%064x", i))
 	}
 }
 
 func TestEmptyTable(t *testing.T) {
 	clearTable()
 
-	req, _ := http.NewRequest("GET", "/domains", nil)
+	req, _ := http.NewRequest("GET", "/watchlist", nil)
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
@@ -66,24 +81,36 @@ func TestEmptyTable(t *testing.T) {
 func TestGetNonExistentRecord(t *testing.T) {
 	clearTable()
 
-	req, _ := http.NewRequest("GET", "/domain/0x21.org", nil)
+	req, _ := http.NewRequest("GET", "/watchlist/0", nil)
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 
 	var m map[string]string
 	json.Unmarshal(response.Body.Bytes(), &m)
-	if m["error"] != "Domain not found" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Domain not found'. Got '%s'", m["error"])
+	if m["error"] != "Watched domain not found" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Watched domain not found'. Got '%s'", m["error"])
 	}
 }
 
+// addWatched adds a watched domain through the API, returning its ID
+func addWatched(t *testing.T, payload string) int64 {
+	req, _ := http.NewRequest("POST", "/watchlist", bytes.NewBufferString(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	id, _ := m["id"].(float64)
+	return int64(id)
+}
+
 func TestAddRecord(t *testing.T) {
 	clearTable()
 
 	payload := []byte(`{"domain":"test.com","server":"testtube"}`)
 
-	req, _ := http.NewRequest("POST", "/domain", bytes.NewBuffer(payload))
+	req, _ := http.NewRequest("POST", "/watchlist", bytes.NewBuffer(payload))
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusCreated, response.Code)
@@ -99,62 +126,148 @@ func TestAddRecord(t *testing.T) {
 		t.Errorf("Expected product pem to be 'testtube'. Got '%v'", m["server"])
 	}
 
+	if location := response.Header().Get("Location"); location != fmt.Sprintf("/watchlist/%v", m["id"]) {
+		t.Errorf("Expected the location of the new domain. Got '%s'", location)
+	}
+
+	var count int
+	a.DB.QueryRow("SELECT count(*) FROM watched_domains WHERE domain='test.com' AND log_name='testtube'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected the domain to be stored once, found %d", count)
+	}
+}
+
+func TestAddDuplicateRecord(t *testing.T) {
+	clearTable()
+	addWatched(t, `{"domain":"test.com"}`)
+
+	req, _ := http.NewRequest("POST", "/watchlist", bytes.NewBufferString(`{"domain":"TEST.com."}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestAddInvalidRecord(t *testing.T) {
+	clearTable()
+
+	for _, payload := range []string{`{"domain":""}`, `{"domain":"exa mple.com"}`, `{"domain":"-test.com"}`, `{"domain":"test.com","type":"prefix"}`, `{"domain":`} {
+		req, _ := http.NewRequest("POST", "/watchlist", bytes.NewBufferString(payload))
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+	}
+}
+
+func TestAddWildcardRecord(t *testing.T) {
+	clearTable()
+
+	payload := []byte(`{"domain":"*.test.com","owner":"security"}`)
+
+	req, _ := http.NewRequest("POST", "/watchlist", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["domain"] != "test.com" || m["type"] != "wildcard" || m["owner"] != "security" {
+		t.Errorf("Expected a wildcard on test.com owned by security. Got '%v'", m)
+	}
+}
+
+func TestUpdateRecord(t *testing.T) {
+	clearTable()
+	id := addWatched(t, `{"domain":"test.com","owner":"web","issuers":["DigiCert Inc"]}`)
+	path := "/watchlist/" + strconv.FormatInt(id, 10)
+
+	req, _ := http.NewRequest("PATCH", path, bytes.NewBufferString(`{"issuers":["Let's Encrypt"]}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", path, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	issuers, ok := m["issuers"].([]interface{})
+	if !ok || len(issuers) != 1 || issuers[0] != "Let's Encrypt" || m["owner"] != "web" {
+		t.Errorf("Expected issuers [Let's Encrypt] owned by web. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("PATCH", "/watchlist/0", bytes.NewBufferString(`{"owner":"mail"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
 
 func TestGetRecord(t *testing.T) {
 	clearTable()
 	addRecords(1)
 
-	req, _ := http.NewRequest("GET", "/domain/1.com", nil)
+	req, _ := http.NewRequest("GET", "/certificates?domain=1.com", nil)
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m struct {
+		Certificates []map[string]interface{} `json:"certificates"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if len(m.Certificates) != 1 || m.Certificates[0]["cert"] != testPEM {
+		t.Errorf("Expected the certificate for 1.com. Got %v", m.Certificates)
+	}
 }
 
 func TestDeleteRecord(t *testing.T) {
 	clearTable()
 	addRecords(1)
+	id := addWatched(t, `{"domain":"1.com"}`)
+	path := "/watchlist/" + strconv.FormatInt(id, 10)
 
-	req, _ := http.NewRequest("GET", "/domain/1.com", nil)
+	req, _ := http.NewRequest("GET", path, nil)
 	response := executeRequest(req)
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	req, _ = http.NewRequest("DELETE", "/domain/1.com", nil)
+	req, _ = http.NewRequest("DELETE", path, nil)
 	response = executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	req, _ = http.NewRequest("GET", "/domain/1.com", nil)
+	req, _ = http.NewRequest("GET", path, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("DELETE", path, nil)
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// Certificates found for the domain are kept
+	var count int
+	a.DB.QueryRow("SELECT count(*) FROM certificates WHERE domain='1.com'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected the certificate for 1.com to be kept, found %d", count)
+	}
 }
 
 func TestGetDomains(t *testing.T) {
 	clearTable()
-	addRecords(5)
+	for i := 1; i <= 5; i++ {
+		addWatched(t, `{"domain":"`+strconv.Itoa(i)+`.com","owner":"web"}`)
+	}
+	addWatched(t, `{"domain":"6.com","owner":"mail"}`)
 
-	req, _ := http.NewRequest("GET", "/domains", nil)
+	req, _ := http.NewRequest("GET", "/watchlist?owner=web", nil)
 	response := executeRequest(req)
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	//var m map[string]interface{}
-	var m []string
+	var m []map[string]interface{}
 	json.Unmarshal(response.Body.Bytes(), &m)
 
-	//	data, ok := m["domains"].([]string)
-	//	if !ok || data == nil {
-	//		t.Errorf("Received garbled data: %v", m["domains"])
-	//		return
-	//	}
-	//
-	//	domains := []string(m["domains"].([]string))
-
 	if len(m) != 5 {
 		t.Errorf("Expected 5 values back, got %v", len(m))
 	}
-	for i := 0; i < 5; i++ {
-		if m[i] != strconv.Itoa(i+1)+".com" {
-			t.Errorf("Expected %v at index %d, got %v", strconv.Itoa(i+1)+".com", i, m[i])
+	for i := 0; i < len(m); i++ {
+		if m[i]["domain"] != strconv.Itoa(i+1)+".com" {
+			t.Errorf("Expected %v at index %d, got %v", strconv.Itoa(i+1)+".com", i, m[i]["domain"])
 		}
 	}
 }
@@ -179,7 +292,347 @@ func TestGetNewCerts(t *testing.T) {
 		if record["cert"] != testPEM {
 			t.Errorf("Expected %v at index %d, got %v", testPEM, i, record["cert"])
 		}
+
+		if record["reason"] != "watched" {
+			t.Errorf("Expected reason 'watched' at index %d, got %v", i, record["reason"])
+		}
+
+		logs, ok := record["logs"].([]interface{})
+		if !ok || len(logs) != 1 {
+			t.Errorf("Expected one log at index %d, got %v", i, record["logs"])
+		} else if l, _ := logs[0].(map[string]interface{}); l["log_url"] != "https://ct.googleapis.com/testtube" {
+			t.Errorf("Expected the testtube log at index %d, got %v", i, logs[0])
+		}
+
+		names, ok := record["names"].([]interface{})
+		if !ok || len(names) != 1 || names[0] != record["domain"] {
+			t.Errorf("Expected names [%v] at index %d, got %v", record["domain"], i, record["names"])
+		}
+	}
+}
+
+func TestStoreOversizedNames(t *testing.T) {
+	clearTable()
+
+	// Logs hold certificates breaking both the DNS and RFC 5280 limits
+	name := strings.Repeat("a", 300) + ".com"
+	serial := strings.Repeat("ff", 40)
+	var id int64
+	err := a.DB.QueryRow(
+		`INSERT INTO certificates(domain, cert_pem, sha256, tbs_sha256, serial, issuer,
+			subject, not_before, not_after, spki_sha256, precert, valid)
+		VALUES($1, $2, $3, $3, $4, 'CN=Test CA', 'CN=test', now(),
+			now() + interval '90 days', $3, false, true)
+		RETURNING id`,
+		name, testPEM, fmt.Sprintf("%064x", 1), serial).Scan(&id)
+	if err != nil {
+		t.Fatalf("Couldn't store a certificate with an oversized name and serial: %s", err)
+	}
+	if _, err = a.DB.Exec("INSERT INTO certificate_names(certificate_id, name) VALUES($1, $2)", id, name); err != nil {
+		t.Errorf("Couldn't store an oversized name: %s", err)
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	clearTable()
+	addRecords(3)
+
+	var id int64
+	a.DB.QueryRow("SELECT id FROM certificates WHERE domain='1.com'").Scan(&id)
+	req, _ := http.NewRequest("POST", "/certificates/"+strconv.FormatInt(id, 10)+"/acknowledge", bytes.NewBufferString(`{"note":"ours"}`))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	payload := []byte(fmt.Sprintf(`{"sha256":"%064x","note":"deploy"}`, 2))
+	req, _ = http.NewRequest("POST", "/acknowledged", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/acknowledged", bytes.NewBufferString(`{"sha256":"beef"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("GET", "/new_certificates?unacknowledged=true", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if len(m) != 1 || m[0]["domain"] != "3.com" || m[0]["acknowledged"] != false {
+		t.Errorf("Expected only 3.com to be unacknowledged. Got %v", m)
+	}
+
+	var verdict string
+	a.DB.QueryRow("SELECT verdict FROM certificates WHERE id=$1", id).Scan(&verdict)
+	if verdict != "expected" {
+		t.Errorf("Expected the acknowledged certificate to be expected. Got '%s'", verdict)
+	}
+}
+
+func TestUpdateCertificate(t *testing.T) {
+	clearTable()
+	addRecords(1)
+
+	var id int64
+	a.DB.QueryRow("SELECT id FROM certificates WHERE domain='1.com'").Scan(&id)
+	path := "/certificates/" + strconv.FormatInt(id, 10)
+
+	payload := []byte(`{"state":"investigating","assignee":"oncall","notes":"Not one of ours"}`)
+	req, _ := http.NewRequest("PATCH", path, bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("PATCH", path, bytes.NewBufferString(`{"state":"revoke-requested"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["state"] != "revoke-requested" || m["assignee"] != "oncall" || m["notes"] != "Not one of ours" {
+		t.Errorf("Expected a revoke-requested incident assigned to oncall. Got %v", m)
+	}
+
+	req, _ = http.NewRequest("PATCH", path, bytes.NewBufferString(`{"state":"closed"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("PATCH", "/certificates/0", bytes.NewBufferString(`{"state":"new"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestGetCertificateDetail(t *testing.T) {
+	clearTable()
+	addRecords(1)
+
+	path := "/certificates/" + fmt.Sprintf("%064x", 1)
+	req, _ := http.NewRequest("GET", path, nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["key_type"] != "RSA" || m["signature_algorithm"] != "SHA256-RSA" || m["error"] != nil {
+		t.Errorf("Expected a parsed RSA certificate. Got %v", m)
+	}
+	if names, ok := m["dns_names"].([]interface{}); !ok || len(names) == 0 {
+		t.Errorf("Expected the certificate's SANs. Got %v", m["dns_names"])
+	}
+
+	req, _ = http.NewRequest("GET", path+"?format=pem", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.TrimSpace(response.Body.String()) != strings.TrimSpace(testPEM) {
+		t.Errorf("Expected the certificate's PEM. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", path+"?format=der", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if response.Header().Get("Content-Type") != "application/pkix-cert" {
+		t.Errorf("Expected a DER download. Got %s", response.Header().Get("Content-Type"))
+	}
+
+	req, _ = http.NewRequest("GET", path+"?format=txt", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	a.DB.Exec("UPDATE certificates SET precert = true")
+	req, _ = http.NewRequest("GET", path+"?format=pem", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("GET", "/certificates/"+fmt.Sprintf("%064x", 2), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// createKey makes an API key while authentication is off
+func createKey(t *testing.T, payload string) string {
+	req, _ := http.NewRequest("POST", "/keys", bytes.NewBufferString(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	key, _ := m["key"].(string)
+	return key
+}
+
+func TestAuthentication(t *testing.T) {
+	clearTable()
+	reader := createKey(t, `{"name":"dashboard","role":"read-only"}`)
+	editor := createKey(t, `{"name":"ci","team":"web","role":"watchlist-editor"}`)
+	admin := createKey(t, `{"name":"ops","role":"admin"}`)
+
+	a.Auth = true
+	defer func() { a.Auth = false }()
+
+	request := func(method, path, key, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		return executeRequest(req)
+	}
+
+	checkResponseCode(t, http.StatusUnauthorized, request("GET", "/watchlist", "", "").Code)
+	checkResponseCode(t, http.StatusUnauthorized, request("GET", "/watchlist", "nope", "").Code)
+	checkResponseCode(t, http.StatusOK, request("GET", "/watchlist", reader, "").Code)
+	checkResponseCode(t, http.StatusForbidden, request("POST", "/watchlist", reader, `{"domain":"web.com"}`).Code)
+	checkResponseCode(t, http.StatusForbidden, request("GET", "/keys", editor, "").Code)
+
+	response := request("POST", "/watchlist", editor, `{"domain":"web.com"}`)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["owner"] != "web" {
+		t.Errorf("Expected the domain to belong to the key's team. Got '%v'", m["owner"])
 	}
+	web := response.Header().Get("Location")
+
+	checkResponseCode(t, http.StatusForbidden, request("POST", "/watchlist", editor, `{"domain":"mail.com","owner":"mail"}`).Code)
+	response = request("POST", "/watchlist", admin, `{"domain":"mail.com","owner":"mail"}`)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	mail := response.Header().Get("Location")
+
+	// Certificates can only be triaged by the team owning their domain
+	addRecords(2)
+	a.DB.Exec("UPDATE certificates SET owner = CASE WHEN domain = '1.com' THEN 'mail' ELSE 'web' END")
+	var mailCert, webCert int64
+	a.DB.QueryRow("SELECT id FROM certificates WHERE domain = '1.com'").Scan(&mailCert)
+	a.DB.QueryRow("SELECT id FROM certificates WHERE domain = '2.com'").Scan(&webCert)
+	mailPath := "/certificates/" + strconv.FormatInt(mailCert, 10)
+	webPath := "/certificates/" + strconv.FormatInt(webCert, 10)
+	checkResponseCode(t, http.StatusForbidden, request("PATCH", mailPath, editor, `{"state":"investigating"}`).Code)
+	checkResponseCode(t, http.StatusForbidden, request("POST", mailPath+"/acknowledge", editor, "").Code)
+	checkResponseCode(t, http.StatusOK, request("PATCH", webPath, editor, `{"state":"investigating"}`).Code)
+	checkResponseCode(t, http.StatusCreated, request("POST", webPath+"/acknowledge", editor, "").Code)
+	checkResponseCode(t, http.StatusOK, request("PATCH", mailPath, admin, `{"state":"investigating"}`).Code)
+
+	// Acknowledging by hash needs every certificate it covers to be the team's
+	mailEditor := createKey(t, `{"name":"postmaster","team":"mail","role":"watchlist-editor"}`)
+	var mailHash string
+	a.DB.QueryRow("SELECT sha256 FROM certificates WHERE id = $1", mailCert).Scan(&mailHash)
+	mailAck := `{"sha256":"` + mailHash + `"}`
+	unstored := `{"sha256":"` + strings.Repeat("ab", 32) + `"}`
+	checkResponseCode(t, http.StatusForbidden, request("POST", "/acknowledged", editor, mailAck).Code)
+	checkResponseCode(t, http.StatusCreated, request("POST", "/acknowledged", mailEditor, mailAck).Code)
+	checkResponseCode(t, http.StatusForbidden, request("POST", "/acknowledged", mailEditor, unstored).Code)
+	checkResponseCode(t, http.StatusCreated, request("POST", "/acknowledged", admin, unstored).Code)
+
+	checkResponseCode(t, http.StatusForbidden, request("DELETE", mail, editor, "").Code)
+	checkResponseCode(t, http.StatusForbidden, request("PATCH", web, editor, `{"owner":"mail"}`).Code)
+	checkResponseCode(t, http.StatusOK, request("PATCH", web, editor, `{"issuers":["Let's Encrypt"]}`).Code)
+	checkResponseCode(t, http.StatusOK, request("DELETE", web, editor, "").Code)
+
+	// Bodies too large to keep in the audit log are refused before anything is done
+	huge := `{"domain":"web.com","owner":"` + strings.Repeat("x", 1<<20) + `"}`
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, request("POST", "/watchlist", admin, huge).Code)
+
+	response = request("GET", "/audit", admin, "")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var entries []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &entries)
+	if len(entries) < 6 || entries[0]["method"] != "DELETE" || entries[0]["key_name"] != "ci" ||
+		entries[0]["status"] != float64(http.StatusOK) {
+		t.Errorf("Expected the calls in the audit log, newest first. Got %v", entries)
+	}
+}
+
+func TestSearchCertificates(t *testing.T) {
+	clearTable()
+	addRecords(25)
+
+	seen := make(map[string]bool)
+	path := "/certificates?limit=10&sort=created_at&order=asc"
+	for page := 0; page < 3; page++ {
+		req, _ := http.NewRequest("GET", path, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var m struct {
+			Certificates []map[string]interface{} `json:"certificates"`
+			Next         string                   `json:"next"`
+		}
+		json.Unmarshal(response.Body.Bytes(), &m)
+		for _, c := range m.Certificates {
+			seen[c["domain"].(string)] = true
+		}
+		if (m.Next == "") != (page == 2) {
+			t.Errorf("Unexpected next cursor '%s' on page %d", m.Next, page)
+		}
+		path = "/certificates?limit=10&sort=created_at&order=asc&cursor=" + m.Next
+	}
+	if len(seen) != 25 {
+		t.Errorf("Expected to page through 25 certificates, saw %d", len(seen))
+	}
+
+	req, _ := http.NewRequest("GET", "/certificates?domain==7.com&log=testtube&valid=true", nil)
+	response := executeRequest(req)
+	var m struct {
+		Certificates []map[string]interface{} `json:"certificates"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if len(m.Certificates) != 1 || m.Certificates[0]["domain"] != "7.com" {
+		t.Errorf("Expected only 7.com. Got %v", m.Certificates)
+	}
+
+	req, _ = http.NewRequest("GET", "/certificates?sort=serial", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGetTimeline(t *testing.T) {
+	clearTable()
+	addRecords(2)
+	a.DB.Exec("INSERT INTO certificate_names(certificate_id, name) SELECT id, '*.1.com' FROM certificates WHERE domain='2.com'")
+
+	req, _ := http.NewRequest("GET", "/domain/www.1.com/timeline", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	certs, ok := m["certificates"].([]interface{})
+	if !ok || len(certs) != 1 {
+		t.Errorf("Expected the wildcard certificate covering www.1.com. Got %v", m["certificates"])
+	}
+
+	req, _ = http.NewRequest("GET", "/domain/0x21.org/timeline", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestGetBackfills(t *testing.T) {
+	clearTable()
+	a.DB.Exec(
+		`INSERT INTO backfills(domain, log_name, start_index, end_index, next_index, state)
+		VALUES('test.com', 'testtube', 0, 100, 40, 'running')`)
+
+	req, _ := http.NewRequest("GET", "/backfills?state=running", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if len(m) != 1 || m[0]["index"] != 40.0 || m[0]["end"] != 100.0 {
+		t.Errorf("Expected one running backfill at 40 of 100. Got %v", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/backfills/"+strconv.Itoa(int(m[0]["id"].(float64))), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/backfills?state=done", nil)
+	response = executeRequest(req)
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected no finished backfills. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("GET", "/backfills/0", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
 
 func TestMain(m *testing.M) {
@@ -190,8 +643,6 @@ func TestMain(m *testing.M) {
 		os.Getenv("TEST_DB_PASSWORD"),
 		os.Getenv("TEST_DB_NAME"))
 
-	ensureTableExists()
-
 	code := m.Run()
 
 	clearTable()
@@ -199,13 +650,6 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-const tableCreationQuery = `CREATE TABLE IF NOT EXISTS domains
-(
-	domain varchar (253) NOT NULL,
-	cert_pem varchar NOT NULL,
-	created_at timestamp NOT NULL DEFAULT(clock_timestamp())
-)`
-
 const testPEM = `-----BEGIN CERTIFICATE-----
 MIIFWTCCBEGgAwIBAgIQKcAeK/vRrCIRYJslHLtUXjANBgkqhkiG9w0BAQsFADCB
 kDELMAkGA1UEBhMCR0IxGzAZBgNVBAgTEkdyZWF0ZXIgTWFuY2hlc3RlcjEQMA4G
@@ -0,0 +1,342 @@
+// matcher.go
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+// ErrMatcherConfig if a matcher in the configuration is malformed
+var ErrMatcherConfig = errors.New("Error invalid matcher configuration")
+
+// Kinds of hostname patterns understood in the configuration
+const (
+	// "example.com" matches example.com and every name below it
+	patternSuffix = iota
+	// "*.example.com" matches exactly one label below example.com
+	patternWildcard
+	// "=example.com" matches example.com and nothing else
+	patternExact
+)
+
+// Names of the pattern kinds, as stored in the database
+var (
+	patternTypes = map[int]string{patternSuffix: "suffix", patternWildcard: "wildcard", patternExact: "exact"}
+	patternKinds = map[string]int{"suffix": patternSuffix, "wildcard": patternWildcard, "exact": patternExact}
+)
+
+type domainPattern struct {
+	kind int
+	name string
+}
+
+// String returns the pattern as it would be written in the configuration
+func (p domainPattern) String() string {
+	switch p.kind {
+	case patternExact:
+		return "=" + p.name
+	case patternWildcard:
+		return "*." + p.name
+	default:
+		return p.name
+	}
+}
+
+// normalizeName lower-cases a DNS name and strips any trailing dot
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// parentDomain returns everything after the first label of name
+func parentDomain(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+func parsePattern(pattern string) domainPattern {
+	pattern = normalizeName(pattern)
+	switch {
+	case strings.HasPrefix(pattern, "="):
+		return domainPattern{patternExact, pattern[1:]}
+	case strings.HasPrefix(pattern, "*."):
+		return domainPattern{patternWildcard, pattern[2:]}
+	default:
+		return domainPattern{patternSuffix, pattern}
+	}
+}
+
+// certNames returns every DNS SAN of the certificate, plus the subject CN if
+// it isn't already among them
+func certNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, len(cert.DNSNames)+1)
+	names = append(names, cert.DNSNames...)
+	cn := cert.Subject.CommonName
+	if cn == "" {
+		return names
+	}
+	for _, name := range names {
+		if normalizeName(name) == normalizeName(cn) {
+			return names
+		}
+	}
+	return append(names, cn)
+}
+
+// Matcher decides whether a certificate found in a log is interesting. It is
+// handed to the scanner so that everything else is discarded before we do any
+// further work on it.
+type Matcher interface {
+	Match(cert *x509.Certificate) bool
+}
+
+// MatcherConfig describes a Matcher in the configuration file, e.g.
+//
+//	{"type":"and","matchers":[{"type":"hostnames"},{"type":"not","matchers":[{"type":"issuer","values":["Let's Encrypt"]}]}]}
+type MatcherConfig struct {
+	Type     string          `json:"type"`
+	Values   []string        `json:"values,omitempty"`
+	Matchers []MatcherConfig `json:"matchers,omitempty"`
+}
+
+// hostnameMatcher matches against the live list of watched hostnames for a log
+type hostnameMatcher struct {
+	server string
+}
+
+func (m hostnameMatcher) Match(cert *x509.Certificate) bool {
+	_, _, ok := hostnames.index(m.server).matchCert(cert)
+	return ok
+}
+
+// lookalikeMatcher matches names confusingly similar to a log's watched hostnames
+type lookalikeMatcher struct {
+	server string
+}
+
+func (m lookalikeMatcher) Match(cert *x509.Certificate) bool {
+	_, ok := hostnames.index(m.server).lookalikeCert(cert)
+	return ok
+}
+
+// domainMatcher matches against a fixed list of hostname patterns
+type domainMatcher struct {
+	*domainIndex
+}
+
+func (m domainMatcher) Match(cert *x509.Certificate) bool {
+	_, _, ok := m.matchCert(cert)
+	return ok
+}
+
+// domainLookalikeMatcher matches names confusingly similar to a fixed list of
+// hostname patterns
+type domainLookalikeMatcher struct {
+	*domainIndex
+}
+
+func (m domainLookalikeMatcher) Match(cert *x509.Certificate) bool {
+	_, ok := m.lookalikeCert(cert)
+	return ok
+}
+
+// regexMatcher matches if any name on the certificate matches the expression
+type regexMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m regexMatcher) Match(cert *x509.Certificate) bool {
+	for _, name := range certNames(cert) {
+		if m.re.MatchString(normalizeName(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// organizationMatcher matches on the subject's organization name
+type organizationMatcher []string
+
+func (m organizationMatcher) Match(cert *x509.Certificate) bool {
+	return containsFold(m, cert.Subject.Organization...)
+}
+
+// issuerMatcher matches on the issuer's common name or organization name
+type issuerMatcher []string
+
+func (m issuerMatcher) Match(cert *x509.Certificate) bool {
+	return containsFold(m, cert.Issuer.CommonName) || containsFold(m, cert.Issuer.Organization...)
+}
+
+// spkiMatcher matches on the hex SHA-256 of the subject public key info
+type spkiMatcher []string
+
+func (m spkiMatcher) Match(cert *x509.Certificate) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return containsFold(m, hex.EncodeToString(hash[:]))
+}
+
+// ipMatcher matches if any IP SAN lies within one of the networks
+type ipMatcher []*net.IPNet
+
+func (m ipMatcher) Match(cert *x509.Certificate) bool {
+	for _, ip := range cert.IPAddresses {
+		for _, network := range m {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type andMatcher []Matcher
+
+func (m andMatcher) Match(cert *x509.Certificate) bool {
+	for _, matcher := range m {
+		if !matcher.Match(cert) {
+			return false
+		}
+	}
+	return true
+}
+
+type orMatcher []Matcher
+
+func (m orMatcher) Match(cert *x509.Certificate) bool {
+	for _, matcher := range m {
+		if matcher.Match(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+type notMatcher struct {
+	Matcher
+}
+
+func (m notMatcher) Match(cert *x509.Certificate) bool {
+	return !m.Matcher.Match(cert)
+}
+
+func containsFold(list []string, values ...string) bool {
+	for _, value := range values {
+		for _, item := range list {
+			if strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewMatcher builds a Matcher from its configuration. server names the log
+// whose watched hostnames a "hostnames" matcher refers to.
+func NewMatcher(conf MatcherConfig, server string) (Matcher, error) {
+	return newMatcher(conf, server, nil)
+}
+
+// newMatcher builds a Matcher as NewMatcher does, with hostname and look-alike
+// matchers using idx rather than the live list of the log's hostnames if set
+func newMatcher(conf MatcherConfig, server string, idx *domainIndex) (Matcher, error) {
+	switch conf.Type {
+	case "hostnames":
+		if idx != nil {
+			return domainMatcher{idx}, nil
+		}
+		return hostnameMatcher{server}, nil
+	case "lookalike":
+		if idx != nil {
+			return domainLookalikeMatcher{idx}, nil
+		}
+		return lookalikeMatcher{server}, nil
+	case "domain":
+		return domainMatcher{newDomainIndex(conf.Values)}, nil
+	case "regex":
+		if len(conf.Values) != 1 {
+			return nil, ErrMatcherConfig
+		}
+		re, err := regexp.Compile(conf.Values[0])
+		if err != nil {
+			return nil, err
+		}
+		return regexMatcher{re}, nil
+	case "organization":
+		return organizationMatcher(conf.Values), nil
+	case "issuer":
+		return issuerMatcher(conf.Values), nil
+	case "spki":
+		return spkiMatcher(conf.Values), nil
+	case "ip":
+		m := make(ipMatcher, len(conf.Values))
+		for i, value := range conf.Values {
+			if !strings.Contains(value, "/") {
+				if strings.Contains(value, ":") {
+					value += "/128"
+				} else {
+					value += "/32"
+				}
+			}
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, err
+			}
+			m[i] = network
+		}
+		return m, nil
+	case "and", "or":
+		children := make([]Matcher, len(conf.Matchers))
+		for i, child := range conf.Matchers {
+			var err error
+			if children[i], err = newMatcher(child, server, idx); err != nil {
+				return nil, err
+			}
+		}
+		if conf.Type == "and" {
+			return andMatcher(children), nil
+		}
+		return orMatcher(children), nil
+	case "not":
+		if len(conf.Matchers) != 1 {
+			return nil, ErrMatcherConfig
+		}
+		child, err := newMatcher(conf.Matchers[0], server, idx)
+		if err != nil {
+			return nil, err
+		}
+		return notMatcher{child}, nil
+	}
+	return nil, ErrMatcherConfig
+}
+
+// logMatcher builds the Matcher for a log, defaulting to its watched hostnames
+// and, in look-alike mode, names resembling them
+func logMatcher(conf LogConfig) (Matcher, error) {
+	return scopedLogMatcher(conf, nil)
+}
+
+// backfillMatcher builds the Matcher for a log as logMatcher does, but with
+// pattern as the only watched hostname
+func backfillMatcher(conf LogConfig, pattern string) (Matcher, error) {
+	return scopedLogMatcher(conf, newDomainIndex([]string{pattern}))
+}
+
+func scopedLogMatcher(conf LogConfig, idx *domainIndex) (Matcher, error) {
+	match := MatcherConfig{Type: "hostnames"}
+	if lookalikeMode {
+		match = MatcherConfig{Type: "or", Matchers: []MatcherConfig{{Type: "hostnames"}, {Type: "lookalike"}}}
+	}
+	if conf.Match != nil {
+		match = *conf.Match
+	}
+	return newMatcher(match, conf.Name, idx)
+}
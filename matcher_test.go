@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+func TestNewMatcher(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:                 pkix.Name{CommonName: "mail.mbernhard.com", Organization: []string{"Bernhard Inc"}},
+		Issuer:                  pkix.Name{CommonName: "GeoTrust DV SSL CA - G3", Organization: []string{"GeoTrust Inc."}},
+		DNSNames:                []string{"mail.mbernhard.com"},
+		IPAddresses:             []net.IP{net.ParseIP("192.0.2.10")},
+		RawSubjectPublicKeyInfo: []byte("spki"),
+	}
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	cases := []struct {
+		conf  MatcherConfig
+		match bool
+	}{
+		{MatcherConfig{Type: "domain", Values: []string{"mbernhard.com"}}, true},
+		{MatcherConfig{Type: "domain", Values: []string{"=mbernhard.com"}}, false},
+		{MatcherConfig{Type: "regex", Values: []string{`^mail\.`}}, true},
+		{MatcherConfig{Type: "organization", Values: []string{"bernhard inc"}}, true},
+		{MatcherConfig{Type: "issuer", Values: []string{"GeoTrust Inc."}}, true},
+		{MatcherConfig{Type: "issuer", Values: []string{"Let's Encrypt"}}, false},
+		{MatcherConfig{Type: "spki", Values: []string{hex.EncodeToString(spki[:])}}, true},
+		{MatcherConfig{Type: "ip", Values: []string{"192.0.2.0/24"}}, true},
+		{MatcherConfig{Type: "ip", Values: []string{"192.0.2.11"}}, false},
+		{MatcherConfig{Type: "and", Matchers: []MatcherConfig{
+			{Type: "domain", Values: []string{"mbernhard.com"}},
+			{Type: "not", Matchers: []MatcherConfig{{Type: "issuer", Values: []string{"GeoTrust Inc."}}}},
+		}}, false},
+		{MatcherConfig{Type: "or", Matchers: []MatcherConfig{
+			{Type: "domain", Values: []string{"example.com"}},
+			{Type: "organization", Values: []string{"Bernhard Inc"}},
+		}}, true},
+	}
+
+	for _, c := range cases {
+		m, err := NewMatcher(c.conf, "")
+		if err != nil {
+			t.Errorf("Couldn't build %v: %s", c.conf, err)
+			continue
+		}
+		if got := m.Match(cert); got != c.match {
+			t.Errorf("%v: expected %v, got %v", c.conf, c.match, got)
+		}
+	}
+
+	for _, conf := range []MatcherConfig{
+		{Type: "bogus"},
+		{Type: "regex", Values: []string{"("}},
+		{Type: "ip", Values: []string{"not-an-ip"}},
+		{Type: "not"},
+	} {
+		if _, err := NewMatcher(conf, ""); err == nil {
+			t.Errorf("Expected an error building %v", conf)
+		}
+	}
+}
+
+func TestBackfillMatcher(t *testing.T) {
+	defer func(mode bool) { lookalikeMode = mode }(lookalikeMode)
+	certFor := func(name, issuer string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:  pkix.Name{CommonName: name},
+			Issuer:   pkix.Name{CommonName: issuer},
+			DNSNames: []string{name},
+		}
+	}
+	watched := certFor("mail.mbernhard.com", "GeoTrust DV SSL CA - G3")
+	other := certFor("mail.example.com", "GeoTrust DV SSL CA - G3")
+	lookalike := certFor("rnbernhard.com", "GeoTrust DV SSL CA - G3")
+
+	cases := []struct {
+		lookalikes bool
+		match      *MatcherConfig
+		matches    map[*x509.Certificate]bool
+	}{
+		{false, nil, map[*x509.Certificate]bool{watched: true, other: false, lookalike: false}},
+		{true, nil, map[*x509.Certificate]bool{watched: true, other: false, lookalike: true}},
+		// The log's own rules apply, with its hostnames being the new pattern
+		{false, &MatcherConfig{Type: "and", Matchers: []MatcherConfig{
+			{Type: "hostnames"},
+			{Type: "not", Matchers: []MatcherConfig{{Type: "issuer", Values: []string{"GeoTrust DV SSL CA - G3"}}}},
+		}}, map[*x509.Certificate]bool{watched: false, other: false, lookalike: false}},
+		{false, &MatcherConfig{Type: "lookalike"}, map[*x509.Certificate]bool{watched: false, other: false, lookalike: true}},
+	}
+	for i, c := range cases {
+		lookalikeMode = c.lookalikes
+		m, err := backfillMatcher(LogConfig{Name: "testtube", Match: c.match}, "mbernhard.com")
+		if err != nil {
+			t.Errorf("%d: couldn't build the matcher: %s", i, err)
+			continue
+		}
+		for cert, expected := range c.matches {
+			if got := m.Match(cert); got != expected {
+				t.Errorf("%d: %s: expected %v, got %v", i, cert.Subject.CommonName, expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// migrations.go
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+// ErrSchemaTooNew if the database was migrated by a newer version of the monitor
+var ErrSchemaTooNew = errors.New("Error database schema is newer than this monitor")
+
+// ErrSchemaVersion if asked to migrate to a version that doesn't exist
+var ErrSchemaVersion = errors.New("Error unknown schema version")
+
+// migration is a step in the evolution of the database schema. Migration i
+// takes the schema from version i to version i+1 and back. Released
+// migrations must never be edited; add a new one instead.
+type migration struct {
+	// Either may be empty for a migration that only moves data
+	up   string
+	down string
+	// Run after up to bring over data SQL alone can't, if set
+	data func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		up: `CREATE TABLE certificates
+		(
+			id serial PRIMARY KEY,
+			domain varchar (253) NOT NULL,
+			cert_pem varchar NOT NULL,
+			sha256 char (64) NOT NULL,
+			tbs_sha256 varchar (64) NOT NULL,
+			serial varchar (64) NOT NULL,
+			issuer varchar NOT NULL,
+			subject varchar NOT NULL,
+			not_before timestamp NOT NULL,
+			not_after timestamp NOT NULL,
+			spki_sha256 char (64) NOT NULL,
+			precert boolean NOT NULL,
+			valid boolean NOT NULL,
+			reason varchar (16) NOT NULL DEFAULT 'watched',
+			score real NOT NULL DEFAULT 1,
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp()),
+			UNIQUE (issuer, serial)
+		);
+		CREATE INDEX certificates_sha256 ON certificates (sha256);
+		CREATE INDEX certificates_tbs_sha256 ON certificates (tbs_sha256);
+		CREATE TABLE certificate_names
+		(
+			certificate_id integer NOT NULL REFERENCES certificates (id) ON DELETE CASCADE,
+			name varchar (253) NOT NULL,
+			PRIMARY KEY (certificate_id, name)
+		);
+		CREATE INDEX certificate_names_name ON certificate_names (name);
+		CREATE TABLE certificate_sightings
+		(
+			id serial PRIMARY KEY,
+			certificate_id integer NOT NULL REFERENCES certificates (id) ON DELETE CASCADE,
+			log_name varchar NOT NULL,
+			log_url varchar NOT NULL,
+			log_index bigint NOT NULL,
+			sct_timestamp timestamp NOT NULL,
+			precert boolean NOT NULL,
+			sha256 char (64) NOT NULL,
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp()),
+			UNIQUE (log_url, log_index)
+		)`,
+		down: `DROP TABLE certificate_sightings;
+		DROP TABLE certificate_names;
+		DROP TABLE certificates`,
+	},
+	{
+		up: `CREATE TABLE watched_domains
+		(
+			id serial PRIMARY KEY,
+			domain varchar (253) NOT NULL,
+			pattern_type varchar (16) NOT NULL DEFAULT 'suffix',
+			owner varchar NOT NULL DEFAULT '',
+			log_name varchar NOT NULL DEFAULT '',
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp()),
+			UNIQUE (domain, pattern_type, log_name)
+		)`,
+		down: `DROP TABLE watched_domains`,
+	},
+	{
+		up: `CREATE TABLE backfills
+		(
+			id serial PRIMARY KEY,
+			domain varchar (255) NOT NULL,
+			log_name varchar NOT NULL,
+			start_index bigint NOT NULL,
+			end_index bigint NOT NULL,
+			next_index bigint NOT NULL,
+			state varchar (16) NOT NULL,
+			error varchar NOT NULL DEFAULT '',
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp()),
+			updated_at timestamp NOT NULL DEFAULT(clock_timestamp())
+		);
+		CREATE INDEX backfills_state ON backfills (state)`,
+		down: `DROP TABLE backfills`,
+	},
+	{
+		up: `CREATE TABLE alert_outbox
+		(
+			id serial PRIMARY KEY,
+			notifier varchar NOT NULL,
+			payload text NOT NULL,
+			state varchar (16) NOT NULL,
+			attempts integer NOT NULL DEFAULT 0,
+			next_attempt timestamp NOT NULL,
+			last_error varchar NOT NULL DEFAULT '',
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp()),
+			delivered_at timestamp
+		);
+		CREATE INDEX alert_outbox_due ON alert_outbox (notifier, state, next_attempt)`,
+		down: `DROP TABLE alert_outbox`,
+	},
+	{
+		up: `ALTER TABLE watched_domains ADD allowed_issuers varchar[] NOT NULL DEFAULT '{}';
+		ALTER TABLE certificates ADD verdict varchar (16) NOT NULL DEFAULT ''`,
+		down: `ALTER TABLE certificates DROP verdict;
+		ALTER TABLE watched_domains DROP allowed_issuers`,
+	},
+	{
+		up: `CREATE TABLE acknowledged_certificates
+		(
+			id serial PRIMARY KEY,
+			sha256 varchar (64) NOT NULL DEFAULT '',
+			tbs_sha256 varchar (64) NOT NULL DEFAULT '',
+			note varchar NOT NULL DEFAULT '',
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp()),
+			UNIQUE (sha256, tbs_sha256),
+			CHECK (sha256 <> '' OR tbs_sha256 <> '')
+		);
+		CREATE INDEX acknowledged_certificates_sha256 ON acknowledged_certificates (sha256);
+		CREATE INDEX acknowledged_certificates_tbs_sha256 ON acknowledged_certificates (tbs_sha256)`,
+		down: `DROP TABLE acknowledged_certificates`,
+	},
+	{
+		up: `ALTER TABLE certificates
+			ADD state varchar (32) NOT NULL DEFAULT 'new',
+			ADD assignee varchar NOT NULL DEFAULT '',
+			ADD notes text NOT NULL DEFAULT '',
+			ADD state_changed_at timestamp NOT NULL DEFAULT(clock_timestamp()),
+			ADD updated_at timestamp NOT NULL DEFAULT(clock_timestamp());
+		UPDATE certificates SET state_changed_at = created_at, updated_at = created_at;
+		CREATE INDEX certificates_state ON certificates (state)`,
+		down: `ALTER TABLE certificates DROP state, DROP assignee, DROP notes,
+			DROP state_changed_at, DROP updated_at`,
+	},
+	{
+		up:   `ALTER TABLE certificates ADD chain_pem text NOT NULL DEFAULT ''`,
+		down: `ALTER TABLE certificates DROP chain_pem`,
+	},
+	{
+		up: `CREATE TABLE api_keys
+		(
+			id serial PRIMARY KEY,
+			name varchar NOT NULL,
+			team varchar NOT NULL DEFAULT '',
+			role varchar (32) NOT NULL,
+			key_sha256 char (64) NOT NULL UNIQUE,
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp())
+		);
+		CREATE TABLE audit_log
+		(
+			id serial PRIMARY KEY,
+			key_id integer NOT NULL DEFAULT 0,
+			key_name varchar NOT NULL DEFAULT '',
+			team varchar NOT NULL DEFAULT '',
+			method varchar (16) NOT NULL,
+			path varchar NOT NULL,
+			body text NOT NULL DEFAULT '',
+			status integer NOT NULL,
+			remote_addr varchar NOT NULL DEFAULT '',
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp())
+		)`,
+		down: `DROP TABLE audit_log;
+		DROP TABLE api_keys`,
+	},
+	{
+		// The owner of the watched domain a certificate was stored for, so
+		// team keys can only triage their own. Certificates stored before
+		// get the owner of the most specific pattern still watched for them,
+		// picked as the domain index does: exact, then wildcard, then the
+		// deepest suffix.
+		up: `ALTER TABLE certificates ADD owner varchar NOT NULL DEFAULT '';
+		UPDATE certificates c SET owner = w.owner FROM (
+			SELECT DISTINCT ON (c.id) c.id, w.owner FROM certificates c
+			JOIN watched_domains w ON CASE w.pattern_type
+				WHEN 'exact' THEN c.domain = w.domain
+				WHEN 'wildcard' THEN right(c.domain, length(w.domain) + 1) = '.' || w.domain
+					AND strpos(left(c.domain, -length(w.domain) - 1), '.') = 0
+				ELSE c.domain = w.domain OR right(c.domain, length(w.domain) + 1) = '.' || w.domain
+			END
+			ORDER BY c.id, w.pattern_type = 'exact' DESC, w.pattern_type = 'wildcard' DESC,
+				length(w.domain) DESC
+		) w WHERE c.id = w.id`,
+		down: `ALTER TABLE certificates DROP owner`,
+	},
+	{
+		// Names and serials are text since logs hold certificates with SANs
+		// longer than DNS allows and serials longer than RFC 5280 does.
+		// Backfills are for watched domains, so take their length.
+		up: `ALTER TABLE certificates ALTER domain TYPE text, ALTER serial TYPE text;
+		ALTER TABLE certificate_names ALTER name TYPE text;
+		ALTER TABLE backfills ALTER domain TYPE varchar (253)`,
+		down: `ALTER TABLE backfills ALTER domain TYPE varchar (255);
+		ALTER TABLE certificate_names ALTER name TYPE varchar (253);
+		ALTER TABLE certificates ALTER domain TYPE varchar (253), ALTER serial TYPE varchar (64)`,
+	},
+	{
+		// Certificates stored by monitors from before migrations. Only data
+		// is brought over, so there is nothing to undo.
+		data: copyDomains,
+	},
+}
+
+// migrate brings the database schema to the given version, applying up or
+// down migrations as needed. It refuses to touch a schema newer than any
+// migration it knows about.
+func migrate(db *sql.DB, target int) error {
+	if target < 0 || target > len(migrations) {
+		return ErrSchemaVersion
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The lock keeps two monitors starting at once from both migrating
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version integer NOT NULL);
+		LOCK TABLE schema_version IN EXCLUSIVE MODE`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err = tx.Exec("INSERT INTO schema_version(version) VALUES(0)"); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return ErrSchemaTooNew
+	}
+
+	for ; version < target; version++ {
+		log.Noticef("Migrating database schema to version %d", version+1)
+		if up := migrations[version].up; up != "" {
+			if _, err = tx.Exec(up); err != nil {
+				return err
+			}
+		}
+		if data := migrations[version].data; data != nil {
+			if err = data(tx); err != nil {
+				return err
+			}
+		}
+	}
+	for ; version > target; version-- {
+		log.Noticef("Migrating database schema to version %d", version-1)
+		if down := migrations[version-1].down; down != "" {
+			if _, err = tx.Exec(down); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err = tx.Exec("UPDATE schema_version SET version=$1", version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// copyDomains brings the certificates stored in the domains table of monitors
+// from before migrations into the certificates table. The domains table is
+// left as it was, so migrating back down loses nothing. Rows whose
+// certificate can't be parsed, such as the empty ones stored for
+// precertificates, are skipped.
+func copyDomains(tx *sql.Tx) error {
+	var exists bool
+	if err := tx.QueryRow("SELECT to_regclass('domains') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return err
+	}
+
+	type domainRow struct {
+		domain, certPEM string
+		created         time.Time
+	}
+	rows, err := tx.Query("SELECT domain, cert_pem, created_at FROM domains")
+	if err != nil {
+		return err
+	}
+	var stored []domainRow
+	for rows.Next() {
+		var d domainRow
+		if err := rows.Scan(&d.domain, &d.certPEM, &d.created); err != nil {
+			rows.Close()
+			return err
+		}
+		stored = append(stored, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	skipped := 0
+	for _, d := range stored {
+		block, _ := pem.Decode([]byte(d.certPEM))
+		if block == nil {
+			skipped++
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			skipped++
+			continue
+		}
+		tbsHash, err := issuanceHash(cert.RawTBSCertificate)
+		if err != nil {
+			skipped++
+			continue
+		}
+		fingerprint := sha256.Sum256(block.Bytes)
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		serial := ""
+		if cert.SerialNumber != nil {
+			serial = hex.EncodeToString(cert.SerialNumber.Bytes())
+		}
+		names := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, name := range certNames(cert) {
+			if name = normalizeName(name); name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+
+		// Only valid certificates were stored, precertificates being empty
+		_, err = tx.Exec(
+			`WITH c AS (
+				INSERT INTO certificates(domain, cert_pem, sha256, tbs_sha256, serial, issuer,
+					subject, not_before, not_after, spki_sha256, precert, valid, created_at)
+				VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, false, true, $11)
+				ON CONFLICT (issuer, serial) DO NOTHING
+				RETURNING id)
+			INSERT INTO certificate_names(certificate_id, name)
+			SELECT c.id, name FROM c, unnest($12::text[]) AS name`,
+			normalizeName(d.domain), d.certPEM, hex.EncodeToString(fingerprint[:]), tbsHash,
+			serial, distinguishedName(cert.Issuer), distinguishedName(cert.Subject),
+			cert.NotBefore, cert.NotAfter, hex.EncodeToString(spki[:]), d.created,
+			pq.Array(names))
+		if err != nil {
+			return err
+		}
+	}
+	if len(stored) > 0 {
+		log.Noticef("Copied %d certificates from the domains table, skipping %d that couldn't be parsed",
+			len(stored)-skipped, skipped)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// migrationDB opens the test database in a schema of its own, so migrations
+// can be run up and down without touching the tables the API tests use
+func migrationDB(t *testing.T) *sql.DB {
+	db, err := openDatabase(os.Getenv("TEST_DB_USERNAME"), os.Getenv("TEST_DB_PASSWORD"), os.Getenv("TEST_DB_NAME"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The search path belongs to the connection, so keep to one
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`DROP SCHEMA IF EXISTS migration_test CASCADE;
+		CREATE SCHEMA migration_test;
+		SET search_path TO migration_test`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func dropMigrationDB(db *sql.DB) {
+	db.Exec("DROP SCHEMA migration_test CASCADE")
+	db.Close()
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := migrationDB(t)
+	defer dropMigrationDB(db)
+
+	// A database left by a monitor from before migrations
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "mbernhard.com"},
+		Issuer:       pkix.Name{CommonName: "Test CA"},
+		DNSNames:     []string{"mbernhard.com", "www.mbernhard.com"},
+		NotBefore:    time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := string(pem.EncodeToMemory(&pem.Block{Type: "TRUSTED CERTIFICATE", Bytes: der}))
+	created := time.Date(2017, 2, 1, 12, 0, 0, 0, time.UTC)
+	empty := string(pem.EncodeToMemory(&pem.Block{Type: "TRUSTED CERTIFICATE"}))
+	_, err = db.Exec(`CREATE TABLE domains
+		(
+			domain varchar (253) NOT NULL,
+			cert_pem varchar NOT NULL,
+			created_at timestamp NOT NULL DEFAULT(clock_timestamp())
+		);
+		INSERT INTO domains(domain, cert_pem, created_at) VALUES
+			('www.mbernhard.com', $1, $2), ('mbernhard.com', $3, $2)`, cert, created, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = migrate(db, len(migrations)); err != nil {
+		t.Fatalf("Couldn't migrate up: %s", err)
+	}
+	var domain, serial string
+	var names []string
+	var stored time.Time
+	err = db.QueryRow(`SELECT domain, serial, created_at,
+			ARRAY(SELECT name FROM certificate_names WHERE certificate_id = c.id ORDER BY name)
+		FROM certificates c`).Scan(&domain, &serial, &stored, pq.Array(&names))
+	if err != nil {
+		t.Fatalf("Expected the certificate to be copied from the domains table: %s", err)
+	}
+	if domain != "www.mbernhard.com" || serial != "2a" || !stored.Equal(created) ||
+		len(names) != 2 || names[0] != "mbernhard.com" {
+		t.Errorf("Expected the copied certificate to keep what was stored, got %s %s %s %v",
+			domain, serial, stored, names)
+	}
+
+	if err = migrate(db, 0); err != nil {
+		t.Fatalf("Couldn't migrate down: %s", err)
+	}
+	var version, count int
+	db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	db.QueryRow("SELECT count(*) FROM domains").Scan(&count)
+	var certificates sql.NullString
+	db.QueryRow("SELECT to_regclass('certificates')").Scan(&certificates)
+	if version != 0 || count != 2 || certificates.Valid {
+		t.Errorf("Expected only the domains table left at version 0, got version %d, %d rows, %v",
+			version, count, certificates)
+	}
+
+	if err = migrate(db, len(migrations)); err != nil {
+		t.Errorf("Couldn't migrate back up: %s", err)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	db := migrationDB(t)
+	defer dropMigrationDB(db)
+
+	if err := migrate(db, len(migrations)+1); err != ErrSchemaVersion {
+		t.Errorf("Expected an unknown version to be refused, got %v", err)
+	}
+	if err := migrate(db, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE schema_version SET version = $1", len(migrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, len(migrations)); err != ErrSchemaTooNew {
+		t.Errorf("Expected a newer schema to be refused, got %v", err)
+	}
+	var version int
+	db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if version != len(migrations)+1 {
+		t.Errorf("Expected the newer schema to be left alone, got version %d", version)
+	}
+}
+
+func TestMigrateCertificateOwners(t *testing.T) {
+	db := migrationDB(t)
+	defer dropMigrationDB(db)
+
+	// The version before certificates had owners
+	const beforeOwners = 9
+	if err := migrate(db, beforeOwners); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec(`INSERT INTO watched_domains(domain, pattern_type, owner) VALUES
+		('example.com', 'suffix', 'web'), ('shop.example.com', 'suffix', 'shop'),
+		('api.example.com', 'exact', 'api'), ('cdn.example.com', 'wildcard', 'cdn'),
+		('a_b.com', 'suffix', 'escaped')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := map[string]string{
+		"example.com":           "web",
+		"www.shop.example.com":  "shop",
+		"api.example.com":       "api",
+		"v1.api.example.com":    "web",
+		"img.cdn.example.com":   "cdn",
+		"a.img.cdn.example.com": "web",
+		"cdn.example.com":       "web",
+		"www.axb.com":           "",
+		"notexample.com":        "",
+		"www.a_b.com":           "escaped",
+	}
+	serial := 0
+	for domain := range owners {
+		serial++
+		_, err = db.Exec(`INSERT INTO certificates(domain, cert_pem, sha256, tbs_sha256, serial, issuer,
+				subject, not_before, not_after, spki_sha256, precert, valid)
+			VALUES($1, '', '', '', $2, 'CN=Test CA', '', now(), now(), '', false, true)`, domain, serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = migrate(db, beforeOwners+1); err != nil {
+		t.Fatalf("Couldn't migrate up: %s", err)
+	}
+	rows, err := db.Query("SELECT domain, owner FROM certificates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var domain, owner string
+		if err = rows.Scan(&domain, &owner); err != nil {
+			t.Fatal(err)
+		}
+		if owner != owners[domain] {
+			t.Errorf("Expected %s to belong to '%s', got '%s'", domain, owners[domain], owner)
+		}
+	}
+}
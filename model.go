@@ -4,94 +4,740 @@ package main
 
 import (
 	"database/sql"
-	//	"errors"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrInvalidDomain if a watched domain can't be parsed
+var ErrInvalidDomain = errors.New("Error invalid domain")
+
+// ErrDomainExists if a domain is already watched
+var ErrDomainExists = errors.New("Error domain already watched")
+
+// ErrInvalidHash if an acknowledgement doesn't have a SHA-256 hash
+var ErrInvalidHash = errors.New("Error invalid hash")
+
+// ErrInvalidState if an incident is moved to a state that doesn't exist
+var ErrInvalidState = errors.New("Error invalid state")
+
+// States of the incident opened for each found certificate
+const (
+	stateNew             = "new"
+	stateInvestigating   = "investigating"
+	stateAcknowledged    = "acknowledged"
+	stateRevokeRequested = "revoke-requested"
+	stateFalsePositive   = "false-positive"
 )
 
+var incidentStates = map[string]bool{
+	stateNew:             true,
+	stateInvestigating:   true,
+	stateAcknowledged:    true,
+	stateRevokeRequested: true,
+	stateFalsePositive:   true,
+}
+
+// record is a single issuance: a certificate and its precertificate, however
+// many logs they were found in. Domain is the name it was stored for, Names
+// every DNS name it covers.
 type record struct {
+	ID         int64     `json:"id"`
+	Domain     string    `json:"domain"`
+	Owner      string    `json:"owner"`
+	Names      []string  `json:"names"`
+	Cert       string    `json:"cert"`
+	SHA256     string    `json:"sha256"`
+	TBSSHA256  string    `json:"tbs_sha256"`
+	Serial     string    `json:"serial"`
+	Issuer     string    `json:"issuer"`
+	Subject    string    `json:"subject"`
+	NotBefore  time.Time `json:"not_before"`
+	NotAfter   time.Time `json:"not_after"`
+	SPKISHA256 string    `json:"spki_sha256"`
+	CTServer   string    `json:"server"`
+	Precert    bool      `json:"precert"`
+	Valid      bool      `json:"valid"`
+	Reason     string    `json:"reason"`
+	Score      float64   `json:"score"`
+	Verdict    string    `json:"verdict"`
+	// Whether the certificate matches an acknowledgement
+	Acknowledged bool `json:"acknowledged"`
+	// Where investigating the certificate has got to
+	State        string     `json:"state"`
+	Assignee     string     `json:"assignee"`
+	Notes        string     `json:"notes"`
+	StateChanged string     `json:"state_changed_at"`
+	Sightings    []sighting `json:"logs"`
+	Created      string     `json:"created_at"`
+	Updated      string     `json:"updated_at"`
+	// The PEM of the chain the certificate was logged with
+	chain string
+	// Set by createCertificate if this was the first sighting of the issuance
+	inserted bool
+}
+
+// sighting is a log entry in which an issuance was found
+type sighting struct {
+	CTServer     string    `json:"server"`
+	LogURL       string    `json:"log_url"`
+	LogIndex     int64     `json:"log_index"`
+	SCTTimestamp time.Time `json:"sct_timestamp"`
+	Precert      bool      `json:"precert"`
+	SHA256       string    `json:"sha256"`
+	Created      string    `json:"created_at"`
+}
+
+// Columns read by scanRecord, for certificates aliased as c. The server is the
+// log the issuance was first seen in.
+const recordColumns = `c.id, c.domain, c.owner,
+	ARRAY(SELECT name FROM certificate_names WHERE certificate_id = c.id ORDER BY name),
+	c.cert_pem, c.sha256, c.tbs_sha256, c.serial, c.issuer, c.subject, c.not_before,
+	c.not_after, c.spki_sha256,
+	COALESCE((SELECT log_name FROM certificate_sightings WHERE certificate_id = c.id ORDER BY id LIMIT 1), ''),
+	c.precert, c.valid, c.reason, c.score, c.verdict,
+	EXISTS (SELECT 1 FROM acknowledged_certificates a WHERE ` + acknowledgedMatch + `),
+	c.state, c.assignee, c.notes, c.state_changed_at, c.created_at, c.updated_at`
+
+// Whether acknowledgement a covers certificate c
+const acknowledgedMatch = `(a.sha256 <> '' AND a.sha256 = c.sha256) OR
+	(a.tbs_sha256 <> '' AND a.tbs_sha256 = c.tbs_sha256)`
+
+func scanRecord(row interface {
+	Scan(...interface{}) error
+}) (record, error) {
+	var r record
+	err := row.Scan(&r.ID, &r.Domain, &r.Owner, pq.Array(&r.Names), &r.Cert, &r.SHA256, &r.TBSSHA256,
+		&r.Serial, &r.Issuer, &r.Subject, &r.NotBefore, &r.NotAfter, &r.SPKISHA256,
+		&r.CTServer, &r.Precert, &r.Valid, &r.Reason, &r.Score, &r.Verdict, &r.Acknowledged,
+		&r.State, &r.Assignee, &r.Notes, &r.StateChanged, &r.Created, &r.Updated)
+	return r, err
+}
+
+// getSightings fills in the logs each of the records was found in
+func getSightings(db *sql.DB, records []record) error {
+	ids := make([]int64, len(records))
+	byID := make(map[int64]*record, len(records))
+	for i := range records {
+		ids[i] = records[i].ID
+		byID[records[i].ID] = &records[i]
+		records[i].Sightings = make([]sighting, 0)
+	}
+
+	rows, err := db.Query(
+		`SELECT certificate_id, log_name, log_url, log_index, sct_timestamp, precert, sha256, created_at
+		FROM certificate_sightings WHERE certificate_id = ANY($1) ORDER BY id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var s sighting
+		if err := rows.Scan(&id, &s.CTServer, &s.LogURL, &s.LogIndex, &s.SCTTimestamp,
+			&s.Precert, &s.SHA256, &s.Created); err != nil {
+			return err
+		}
+		if r := byID[id]; r != nil {
+			r.Sightings = append(r.Sightings, s)
+		}
+	}
+
+	return rows.Err()
+}
+
+// createCertificate stores a sighting of a certificate. Precertificates and
+// final certificates from the same issuer with the same serial are the same
+// issuance, which keeps the final certificate once it has been seen.
+// r.inserted reports whether the issuance hadn't been stored before. An
+// acknowledged certificate is stored as expected whatever its verdict. then,
+// if set, runs in the same transaction once the certificate is in, so what
+// it writes is stored along with the certificate or not at all.
+func (r *record) createCertificate(db *sql.DB, then func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`INSERT INTO certificates(domain, cert_pem, sha256, tbs_sha256, serial, issuer,
+			subject, not_before, not_after, spki_sha256, precert, valid, reason, score, verdict,
+			chain_pem, owner)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+			CASE WHEN EXISTS (SELECT 1 FROM acknowledged_certificates a
+				WHERE (a.sha256 <> '' AND a.sha256 = $3) OR (a.tbs_sha256 <> '' AND a.tbs_sha256 = $4))
+			THEN '`+verdictExpected+`' ELSE $15 END, $16, $17)
+		ON CONFLICT (issuer, serial) DO UPDATE SET
+			cert_pem = CASE WHEN EXCLUDED.precert THEN certificates.cert_pem ELSE EXCLUDED.cert_pem END,
+			chain_pem = CASE WHEN EXCLUDED.precert THEN certificates.chain_pem ELSE EXCLUDED.chain_pem END,
+			sha256 = CASE WHEN EXCLUDED.precert THEN certificates.sha256 ELSE EXCLUDED.sha256 END,
+			precert = certificates.precert AND EXCLUDED.precert,
+			valid = certificates.valid OR EXCLUDED.valid,
+			verdict = CASE WHEN EXCLUDED.verdict = '`+verdictExpected+`' THEN EXCLUDED.verdict ELSE certificates.verdict END,
+			owner = CASE WHEN certificates.owner = '' THEN EXCLUDED.owner ELSE certificates.owner END
+		RETURNING id, verdict, created_at, xmax = 0`,
+		r.Domain, r.Cert, r.SHA256, r.TBSSHA256, r.Serial, r.Issuer, r.Subject,
+		r.NotBefore, r.NotAfter, r.SPKISHA256, r.Precert, r.Valid, r.Reason,
+		r.Score, r.Verdict, r.chain, r.Owner).Scan(&r.ID, &r.Verdict, &r.Created, &r.inserted)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range r.Names {
+		_, err = tx.Exec(
+			`INSERT INTO certificate_names(certificate_id, name) VALUES($1, $2)
+			ON CONFLICT DO NOTHING`, r.ID, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range r.Sightings {
+		_, err = tx.Exec(
+			`INSERT INTO certificate_sightings(certificate_id, log_name, log_url, log_index,
+				sct_timestamp, precert, sha256)
+			VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING`,
+			r.ID, s.CTServer, s.LogURL, s.LogIndex, s.SCTTimestamp, s.Precert, s.SHA256)
+		if err != nil {
+			return err
+		}
+	}
+
+	if then != nil {
+		if err = then(tx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// watchedDomain is a hostname pattern we look for in one log, or in every log
+// if CTServer is empty
+type watchedDomain struct {
+	ID       int64  `json:"id"`
 	Domain   string `json:"domain"`
-	Cert     string `json:"cert"`
+	Type     string `json:"type"`
+	Owner    string `json:"owner"`
 	CTServer string `json:"server"`
-	Created  string `json:"created_at"`
+	// Issuers certificates for the domain are expected from, see issuerAllowed
+	Issuers []string `json:"issuers"`
+	Created string   `json:"created_at"`
+}
+
+// A DNS label, allowing the underscores found in service names
+var hostnameLabel = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9_])?$`)
+
+// normalize splits any "*." or "=" prefix off the domain into its type and
+// checks that what's left is a hostname
+func (w *watchedDomain) normalize() error {
+	p := parsePattern(w.Domain)
+	if p.name == "" || len(p.name) > 253 {
+		return ErrInvalidDomain
+	}
+	for _, label := range strings.Split(p.name, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return ErrInvalidDomain
+		}
+	}
+	if w.Type == "" || p.kind != patternSuffix {
+		w.Type = patternTypes[p.kind]
+	} else if _, ok := patternKinds[w.Type]; !ok {
+		return ErrInvalidDomain
+	}
+	w.Domain = p.name
+	w.Issuers = normalizeIssuers(w.Issuers)
+	return nil
+}
+
+func normalizeIssuers(issuers []string) []string {
+	normalized := make([]string, 0, len(issuers))
+	for _, issuer := range issuers {
+		if issuer = strings.TrimSpace(issuer); issuer != "" {
+			normalized = append(normalized, issuer)
+		}
+	}
+	return normalized
+}
+
+// pattern returns the domain in the form the hostname index understands
+func (w *watchedDomain) pattern() string {
+	return domainPattern{patternKinds[w.Type], w.Domain}.String()
+}
+
+// Importing a hostname from the configuration again replaces its allowed
+// issuers, if any are given
+const updateIssuers = `allowed_issuers = CASE WHEN EXCLUDED.allowed_issuers = '{}'
+	THEN watched_domains.allowed_issuers ELSE EXCLUDED.allowed_issuers END`
+
+const watchedColumns = `id, domain, pattern_type, owner, log_name, allowed_issuers, created_at`
+
+func scanWatchedDomain(row interface {
+	Scan(...interface{}) error
+}) (watchedDomain, error) {
+	var w watchedDomain
+	err := row.Scan(&w.ID, &w.Domain, &w.Type, &w.Owner, &w.CTServer, pq.Array(&w.Issuers), &w.Created)
+	return w, err
+}
+
+// createDomain starts watching a domain, returning ErrDomainExists if it
+// already is
+func (w *watchedDomain) createDomain(db *sql.DB) error {
+	log.Debugf("Creating domain %v", w.Domain)
+	created, err := scanWatchedDomain(db.QueryRow(
+		`INSERT INTO watched_domains(domain, pattern_type, owner, log_name, allowed_issuers)
+		VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (domain, pattern_type, log_name) DO NOTHING
+		RETURNING `+watchedColumns,
+		w.Domain, w.Type, w.Owner, w.CTServer, pq.Array(w.Issuers)))
+	if err == sql.ErrNoRows {
+		return ErrDomainExists
+	} else if err != nil {
+		return err
+	}
+
+	*w = created
+	hostnames.add(*w)
+	return nil
+}
+
+func (w *watchedDomain) getDomain(db *sql.DB) error {
+	found, err := scanWatchedDomain(db.QueryRow(
+		`SELECT `+watchedColumns+` FROM watched_domains WHERE id=$1`, w.ID))
+	if err != nil {
+		return err
+	}
+	*w = found
+	return nil
+}
+
+// watchedUpdate changes the fields of a watched domain that aren't nil
+type watchedUpdate struct {
+	Owner   *string   `json:"owner"`
+	Issuers *[]string `json:"issuers"`
+}
+
+func (w *watchedDomain) updateDomain(db *sql.DB, u watchedUpdate) error {
+	var issuers interface{}
+	if u.Issuers != nil {
+		issuers = pq.Array(normalizeIssuers(*u.Issuers))
+	}
+	updated, err := scanWatchedDomain(db.QueryRow(
+		`UPDATE watched_domains SET owner = COALESCE($2, owner),
+			allowed_issuers = COALESCE($3, allowed_issuers)
+		WHERE id=$1 RETURNING `+watchedColumns, w.ID, u.Owner, issuers))
+	if err != nil {
+		return err
+	}
+
+	*w = updated
+	hostnames.add(*w)
+	return nil
+}
+
+// deleteDomain stops watching a domain. Certificates already found for it are
+// kept.
+func (w *watchedDomain) deleteDomain(db *sql.DB) error {
+	res, err := db.Exec(`DELETE FROM watched_domains WHERE id=$1`, w.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+
+	hostnames.remove(w.ID)
+	return nil
 }
 
-func (r *record) getDomain(db *sql.DB) ([]string, error) {
+// getWatchedDomains lists the watched domains, only those in one log or with
+// one owner if server or owner aren't empty
+func getWatchedDomains(db *sql.DB, server, owner string) ([]watchedDomain, error) {
+	rows, err := db.Query(
+		`SELECT `+watchedColumns+` FROM watched_domains
+		WHERE ($1 = '' OR log_name = $1) AND ($2 = '' OR owner = $2) ORDER BY id`, server, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watched := make([]watchedDomain, 0)
+	for rows.Next() {
+		w, err := scanWatchedDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		watched = append(watched, w)
+	}
+
+	return watched, rows.Err()
+}
 
-	rows, err := db.Query("SELECT domain, cert_pem FROM domains WHERE domain=$1", r.Domain)
+func (r *record) getNewCerts(db *sql.DB, unacknowledged bool) ([]record, error) {
+	where := ""
+	if unacknowledged {
+		where = " WHERE NOT EXISTS (SELECT 1 FROM acknowledged_certificates a WHERE " + acknowledgedMatch + ")"
+	}
+	rows, err := db.Query(
+		"SELECT " + recordColumns + " FROM certificates c" + where + " ORDER BY c.created_at DESC LIMIT 10")
 
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	certs := make([]string, 0)
+	records := make([]record, 0)
 
 	for rows.Next() {
-		var r record
-		if err := rows.Scan(&r.Domain, &r.Cert); err != nil {
+		r, err := scanRecord(rows)
+		if err != nil {
 			return nil, err
 		}
-		certs = append(certs, r.Cert)
+		records = append(records, r)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, getSightings(db, records)
+}
+
+// backfill is a scan of part of a log's history for a newly watched domain
+type backfill struct {
+	ID         int64  `json:"id"`
+	Domain     string `json:"domain"`
+	CTServer   string `json:"server"`
+	StartIndex int64  `json:"start"`
+	EndIndex   int64  `json:"end"`
+	NextIndex  int64  `json:"index"`
+	State      string `json:"state"`
+	Error      string `json:"error"`
+	Created    string `json:"created_at"`
+	Updated    string `json:"updated_at"`
+}
 
-	return certs, nil
+const backfillColumns = `id, domain, log_name, start_index, end_index, next_index, state,
+	error, created_at, updated_at`
+
+func scanBackfill(row interface {
+	Scan(...interface{}) error
+}) (backfill, error) {
+	var b backfill
+	err := row.Scan(&b.ID, &b.Domain, &b.CTServer, &b.StartIndex, &b.EndIndex, &b.NextIndex,
+		&b.State, &b.Error, &b.Created, &b.Updated)
+	return b, err
 }
 
-func (r *record) deleteDomain(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM domains WHERE domain=$1", r.Domain)
+func (b *backfill) createBackfill(db *sql.DB) error {
+	return db.QueryRow(
+		`INSERT INTO backfills(domain, log_name, start_index, end_index, next_index, state)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id, created_at, updated_at`,
+		b.Domain, b.CTServer, b.StartIndex, b.EndIndex, b.NextIndex, b.State).Scan(
+		&b.ID, &b.Created, &b.Updated)
+}
 
+func (b *backfill) progressBackfill(db *sql.DB, index int64) error {
+	_, err := db.Exec(
+		`UPDATE backfills SET next_index=$2, updated_at=clock_timestamp()
+		WHERE id=$1 AND state=$3`, b.ID, index, backfillRunning)
 	return err
 }
 
-func (r *record) createDomain(db *sql.DB) {
-	log.Debugf("Creating domain %v", r.Domain)
-	if newHostNames == nil {
-		newHostNames = make(map[string][]string)
+// finishBackfill marks the backfill done, or failed if err isn't nil
+func (b *backfill) finishBackfill(db *sql.DB, err error) {
+	b.State, b.Error = backfillDone, ""
+	if err != nil {
+		b.State, b.Error = backfillFailed, err.Error()
+		log.Noticef("Backfill of %s in %s failed: %s", b.Domain, b.CTServer, err)
+	} else {
+		b.NextIndex = b.EndIndex
+		log.Noticef("Backfill of %s in %s done", b.Domain, b.CTServer)
 	}
-	newHostNames[r.CTServer] = append(newHostNames[r.CTServer], r.Domain)
-
-	if hostnames == nil {
-		hostnames = make(map[string][]string)
+	_, err = db.Exec(
+		`UPDATE backfills SET state=$2, error=$3, next_index=$4, updated_at=clock_timestamp()
+		WHERE id=$1`, b.ID, b.State, b.Error, b.NextIndex)
+	if err != nil {
+		log.Noticef("Couldn't record end of backfill: %s", err)
 	}
-	hostnames[r.CTServer] = append(hostnames[r.CTServer], r.Domain)
 }
 
-func (r *record) getDomains(db *sql.DB) ([]string, error) {
+func (b *backfill) getBackfill(db *sql.DB) error {
+	var err error
+	*b, err = scanBackfill(db.QueryRow("SELECT "+backfillColumns+" FROM backfills WHERE id=$1", b.ID))
+	return err
+}
 
-	rows, err := db.Query("SELECT domain FROM domains")
+// getBackfills lists backfills in the given state, or all of them
+func getBackfills(db *sql.DB, state string) ([]backfill, error) {
+	rows, err := db.Query(
+		"SELECT "+backfillColumns+" FROM backfills WHERE $1 = '' OR state = $1 ORDER BY id", state)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	domains := make([]string, 0)
+	backfills := make([]backfill, 0)
+	for rows.Next() {
+		b, err := scanBackfill(rows)
+		if err != nil {
+			return nil, err
+		}
+		backfills = append(backfills, b)
+	}
+	return backfills, rows.Err()
+}
+
+// outboxEntry is an alert waiting to be delivered to a notifier
+type outboxEntry struct {
+	ID       int64
+	Payload  []byte
+	Attempts int
+}
+
+// States of an outbox entry
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxFailed    = "failed"
+)
+
+// How long a claimed outbox entry is left alone before another attempt
+const outboxLease = "5 minutes"
+
+func enqueueAlert(tx *sql.Tx, notifier string, payload []byte, due time.Time) error {
+	_, err := tx.Exec(
+		`INSERT INTO alert_outbox(notifier, payload, state, next_attempt) VALUES($1, $2, $3, $4)`,
+		notifier, string(payload), outboxPending, due)
+	return err
+}
+
+// dueAlerts claims up to limit pending alerts for the notifier whose time has
+// come, so that no other instance delivers them meanwhile
+func dueAlerts(db *sql.DB, notifier string, limit int) ([]outboxEntry, error) {
+	rows, err := db.Query(
+		`UPDATE alert_outbox SET next_attempt = clock_timestamp() + interval '`+outboxLease+`'
+		WHERE id IN (
+			SELECT id FROM alert_outbox
+			WHERE notifier=$1 AND state=$2 AND next_attempt <= clock_timestamp()
+			ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED)
+		RETURNING id, payload, attempts`, notifier, outboxPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	entries := make([]outboxEntry, 0)
 	for rows.Next() {
-		var d string
-		if err := rows.Scan(&d); err != nil {
+		var e outboxEntry
+		var payload string
+		if err := rows.Scan(&e.ID, &payload, &e.Attempts); err != nil {
 			return nil, err
 		}
-		domains = append(domains, d)
+		e.Payload = []byte(payload)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func deliveredAlerts(db *sql.DB, ids []int64) error {
+	_, err := db.Exec(
+		`UPDATE alert_outbox SET state=$2, attempts=attempts+1, delivered_at=clock_timestamp()
+		WHERE id = ANY($1)`, pq.Array(ids), outboxDelivered)
+	return err
+}
+
+// failAlerts records a failed delivery, to be retried at retry or, if that is
+// zero, given up on
+func failAlerts(db *sql.DB, ids []int64, cause error, retry time.Time) error {
+	state := outboxPending
+	if retry.IsZero() {
+		state, retry = outboxFailed, time.Now()
+	}
+	_, err := db.Exec(
+		`UPDATE alert_outbox SET state=$2, attempts=attempts+1, next_attempt=$3, last_error=$4
+		WHERE id = ANY($1)`, pq.Array(ids), state, retry, cause.Error())
+	return err
+}
+
+// postponeAlerts puts off claimed alerts that weren't tried until retry, or
+// for as long as the lease if that is zero
+func postponeAlerts(db *sql.DB, ids []int64, retry time.Time) error {
+	if len(ids) == 0 || retry.IsZero() {
+		return nil
+	}
+	_, err := db.Exec(`UPDATE alert_outbox SET next_attempt=$2 WHERE id = ANY($1)`, pq.Array(ids), retry)
+	return err
+}
+
+// getCertificate reads the certificate with r.ID
+func (r *record) getCertificate(db *sql.DB) error {
+	found, err := scanRecord(db.QueryRow("SELECT "+recordColumns+" FROM certificates c WHERE c.id=$1", r.ID))
+	if err != nil {
+		return err
+	}
+	records := []record{found}
+	if err := getSightings(db, records); err != nil {
+		return err
+	}
+	*r = records[0]
+	return nil
+}
+
+// getCertificateByHash reads the certificate with r.SHA256, and its chain
+func (r *record) getCertificateByHash(db *sql.DB) error {
+	var chain string
+	err := db.QueryRow(`SELECT id, chain_pem FROM certificates WHERE sha256=$1`, r.SHA256).Scan(&r.ID, &chain)
+	if err != nil {
+		return err
+	}
+	if err := r.getCertificate(db); err != nil {
+		return err
+	}
+	r.chain = chain
+	return nil
+}
+
+// incidentUpdate changes the fields of an incident that aren't nil
+type incidentUpdate struct {
+	State    *string `json:"state"`
+	Assignee *string `json:"assignee"`
+	Notes    *string `json:"notes"`
+}
+
+// updateIncident moves the incident of the certificate with r.ID along and
+// reads it back
+func (r *record) updateIncident(db *sql.DB, u incidentUpdate) error {
+	if u.State != nil && !incidentStates[*u.State] {
+		return ErrInvalidState
+	}
+	res, err := db.Exec(
+		`UPDATE certificates SET
+			state_changed_at = CASE WHEN $2::varchar <> state THEN clock_timestamp() ELSE state_changed_at END,
+			state = COALESCE($2, state),
+			assignee = COALESCE($3, assignee),
+			notes = COALESCE($4, notes),
+			updated_at = clock_timestamp()
+		WHERE id=$1`, r.ID, u.State, u.Assignee, u.Notes)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return r.getCertificate(db)
+}
+
+// acknowledgement is a certificate we know we asked for, by the SHA-256 of
+// the certificate or of its TBSCertificate as issuanceHash computes it, which
+// also covers its precertificate
+type acknowledgement struct {
+	ID        int64  `json:"id"`
+	SHA256    string `json:"sha256"`
+	TBSSHA256 string `json:"tbs_sha256"`
+	Note      string `json:"note"`
+	Created   string `json:"created_at"`
+}
+
+func (k *acknowledgement) normalize() error {
+	k.SHA256 = strings.ToLower(strings.TrimSpace(k.SHA256))
+	k.TBSSHA256 = strings.ToLower(strings.TrimSpace(k.TBSSHA256))
+	if k.SHA256 == "" && k.TBSSHA256 == "" {
+		return ErrInvalidHash
+	}
+	for _, hash := range []string{k.SHA256, k.TBSSHA256} {
+		if hash != "" && !spkiHash.MatchString(hash) {
+			return ErrInvalidHash
+		}
+	}
+	return nil
+}
+
+// owners lists the owners of the stored certificates the acknowledgement
+// would cover
+func (k *acknowledgement) owners(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(
+		`SELECT DISTINCT c.owner FROM certificates c, (SELECT $1::text AS sha256, $2::text AS tbs_sha256) a
+		WHERE `+acknowledgedMatch, k.SHA256, k.TBSSHA256)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return domains, nil
+	owners := make([]string, 0)
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+		owners = append(owners, owner)
+	}
+	return owners, rows.Err()
 }
 
-func (r *record) getNewCerts(db *sql.DB) ([]record, error) {
+// createAcknowledgement stores an acknowledgement and marks the certificates
+// it covers as expected
+func (k *acknowledgement) createAcknowledgement(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`INSERT INTO acknowledged_certificates(sha256, tbs_sha256, note) VALUES($1, $2, $3)
+		ON CONFLICT (sha256, tbs_sha256) DO UPDATE SET note = EXCLUDED.note
+		RETURNING id, created_at`, k.SHA256, k.TBSSHA256, k.Note).Scan(&k.ID, &k.Created)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE certificates c SET verdict = $2,
+			state = CASE WHEN c.state = $3 THEN $4 ELSE c.state END,
+			state_changed_at = CASE WHEN c.state = $3 THEN clock_timestamp() ELSE c.state_changed_at END,
+			updated_at = clock_timestamp()
+		FROM acknowledged_certificates a
+		WHERE a.id = $1 AND (`+acknowledgedMatch+`)`, k.ID, verdictExpected, stateNew, stateAcknowledged)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
 
-	rows, err := db.Query("SELECT * FROM domains ORDER BY created_at DESC LIMIT 10")
+// acknowledge acknowledges the certificate with r.ID after investigation
+func (r *record) acknowledge(db *sql.DB, note string) (acknowledgement, error) {
+	k := acknowledgement{Note: note}
+	err := db.QueryRow(`SELECT sha256, tbs_sha256 FROM certificates WHERE id=$1`, r.ID).Scan(&k.SHA256, &k.TBSSHA256)
+	if err != nil {
+		return k, err
+	}
+	// The TBS hash covers both the precertificate and the final certificate
+	if k.TBSSHA256 != "" {
+		k.SHA256 = ""
+	}
+	return k, k.createAcknowledgement(db)
+}
 
+func getAcknowledgements(db *sql.DB) ([]acknowledgement, error) {
+	rows, err := db.Query(
+		`SELECT id, sha256, tbs_sha256, note, created_at FROM acknowledged_certificates ORDER BY id`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	records := make([]record, 0)
 
+	acks := make([]acknowledgement, 0)
 	for rows.Next() {
-		var r record
-		if err := rows.Scan(&r.Domain, &r.Cert, &r.Created); err != nil {
+		var k acknowledgement
+		if err := rows.Scan(&k.ID, &k.SHA256, &k.TBSSHA256, &k.Note, &k.Created); err != nil {
 			return nil, err
 		}
-		records = append(records, r)
+		acks = append(acks, k)
 	}
 
-	return records, nil
+	return acks, rows.Err()
 }
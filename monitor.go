@@ -3,18 +3,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"encoding/pem"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
-// Monitor contains Router and database
+// Monitor contains Router and database. With Auth set every request needs an
+// API key.
 type Monitor struct {
 	Router *mux.Router
 	DB     *sql.DB
+	Auth   bool
 }
 
 func respondWithError(w http.ResponseWriter, code int, message string) {
@@ -29,33 +35,187 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
-func (a *Monitor) getDomain(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	domain := vars["domain"]
+func (a *Monitor) getWatchlist(w http.ResponseWriter, r *http.Request) {
+	watched, err := getWatchedDomains(a.DB, r.FormValue("server"), r.FormValue("owner"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-	p := record{Domain: domain}
-	certs, err := p.getDomain(a.DB)
+	respondWithJSON(w, http.StatusOK, watched)
+}
 
+func (a *Monitor) createWatched(w http.ResponseWriter, r *http.Request) {
+	var p watchedDomain
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	key := requestKey(r)
+	if key != nil && p.Owner == "" {
+		p.Owner = key.Team
+	}
+	if err := p.normalize(); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid domain")
+		return
+	}
+	if !key.owns(p.Owner) {
+		respondWithError(w, http.StatusForbidden, "Domain owned by another team")
+		return
+	}
+	if err := p.createDomain(a.DB); err != nil {
+		switch err {
+		case ErrDomainExists:
+			respondWithError(w, http.StatusConflict, "Domain already watched")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	if err := backfills.start(a.DB, &p); err != nil {
+		log.Noticef("Couldn't start backfill of %s: %s", p.Domain, err)
+	}
+
+	w.Header().Set("Location", "/watchlist/"+strconv.FormatInt(p.ID, 10))
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+// watchedID reads the ID of a watched domain from the path
+func watchedID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid watched domain ID")
+		return 0, false
+	}
+	return id, true
+}
+
+// ownWatched reads a watched domain the request's key may change
+func (a *Monitor) ownWatched(w http.ResponseWriter, r *http.Request, p *watchedDomain) bool {
+	if err := p.getDomain(a.DB); err != nil {
 		switch err {
 		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Domain not found")
+			respondWithError(w, http.StatusNotFound, "Watched domain not found")
 		default:
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 		}
+		return false
+	}
+	if !requestKey(r).owns(p.Owner) {
+		respondWithError(w, http.StatusForbidden, "Domain owned by another team")
+		return false
+	}
+	return true
+}
+
+func (a *Monitor) getWatched(w http.ResponseWriter, r *http.Request) {
+	id, ok := watchedID(w, r)
+	if !ok {
 		return
-	} else if len(certs) < 1 {
+	}
+
+	p := watchedDomain{ID: id}
+	if err := p.getDomain(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Watched domain not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *Monitor) updateWatched(w http.ResponseWriter, r *http.Request) {
+	id, ok := watchedID(w, r)
+	if !ok {
+		return
+	}
+	var u watchedUpdate
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&u); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	p := watchedDomain{ID: id}
+	if !a.ownWatched(w, r, &p) {
+		return
+	}
+	if u.Owner != nil && !requestKey(r).owns(*u.Owner) {
+		respondWithError(w, http.StatusForbidden, "Domain owned by another team")
+		return
+	}
+	if err := p.updateDomain(a.DB, u); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Watched domain not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *Monitor) deleteWatched(w http.ResponseWriter, r *http.Request) {
+	id, ok := watchedID(w, r)
+	if !ok {
+		return
+	}
+
+	p := watchedDomain{ID: id}
+	if !a.ownWatched(w, r, &p) {
+		return
+	}
+	if err := p.deleteDomain(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Watched domain not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *Monitor) getTimeline(w http.ResponseWriter, r *http.Request) {
+	domain := normalizeName(mux.Vars(r)["domain"])
+
+	records, err := getTimelineRecords(a.DB, domain)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if len(records) < 1 {
 		respondWithError(w, http.StatusNotFound, "Domain not found")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, certs)
+	respondWithJSON(w, http.StatusOK, buildTimeline(domain, records))
 }
 
-func (a *Monitor) getDomains(w http.ResponseWriter, r *http.Request) {
+func (a *Monitor) getNewCerts(w http.ResponseWriter, r *http.Request) {
+	unacknowledged := false
+	if value := r.FormValue("unacknowledged"); value != "" {
+		var err error
+		if unacknowledged, err = strconv.ParseBool(value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid unacknowledged")
+			return
+		}
+	}
 
 	p := record{}
-	d, err := p.getDomains(a.DB)
+	records, err := p.getNewCerts(a.DB, unacknowledged)
+
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
@@ -66,77 +226,434 @@ func (a *Monitor) getDomains(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, d)
+	respondWithJSON(w, http.StatusOK, records)
+}
+func (a *Monitor) getBackfills(w http.ResponseWriter, r *http.Request) {
+	backfills, err := getBackfills(a.DB, r.FormValue("state"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, backfills)
+}
+
+func (a *Monitor) getBackfill(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid backfill ID")
+		return
+	}
+
+	b := backfill{ID: id}
+	if err := b.getBackfill(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Backfill not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, b)
+}
+
+func (a *Monitor) getAcknowledgements(w http.ResponseWriter, r *http.Request) {
+	acks, err := getAcknowledgements(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, acks)
 }
 
-func (a *Monitor) createDomain(w http.ResponseWriter, r *http.Request) {
-	var p record
+func (a *Monitor) createAcknowledgement(w http.ResponseWriter, r *http.Request) {
+	var k acknowledgement
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
+	if err := decoder.Decode(&k); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 	defer r.Body.Close()
 
-	p.createDomain(a.DB)
+	if err := k.normalize(); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid hash")
+		return
+	}
+	// Only admins may acknowledge certificates no team owns yet
+	owners, err := k.owners(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	key := requestKey(r)
+	if len(owners) == 0 && !key.admin() {
+		respondWithError(w, http.StatusForbidden, "Only admins may acknowledge certificates not yet found")
+		return
+	}
+	for _, owner := range owners {
+		if !key.owns(owner) {
+			respondWithError(w, http.StatusForbidden, "Certificate owned by another team")
+			return
+		}
+	}
+	if err := k.createAcknowledgement(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, k)
+}
 
-	respondWithJSON(w, http.StatusCreated, p)
+func (a *Monitor) acknowledgeCertificate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid certificate ID")
+		return
+	}
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+	defer r.Body.Close()
+
+	p := record{ID: id}
+	if !a.ownCertificate(w, r, &p) {
+		return
+	}
+	k, err := p.acknowledge(a.DB, body.Note)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Certificate not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, k)
 }
 
-func (a *Monitor) deleteDomain(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	domain := vars["domain"]
+// ownCertificate reads a certificate the request's key may triage: one stored
+// for a domain its team owns
+func (a *Monitor) ownCertificate(w http.ResponseWriter, r *http.Request, p *record) bool {
+	if err := p.getCertificate(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Certificate not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return false
+	}
+	if !requestKey(r).owns(p.Owner) {
+		respondWithError(w, http.StatusForbidden, "Certificate owned by another team")
+		return false
+	}
+	return true
+}
 
-	p := record{Domain: domain}
-	if err := p.deleteDomain(a.DB); err != nil {
+func (a *Monitor) searchCertificates(w http.ResponseWriter, r *http.Request) {
+	q, err := parseCertificateQuery(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := q.search(a.DB)
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	respondWithJSON(w, http.StatusOK, result)
 }
 
-func (a *Monitor) getNewCerts(w http.ResponseWriter, r *http.Request) {
+func (a *Monitor) getCertificate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid certificate ID")
+		return
+	}
 
-	p := record{}
-	records, err := p.getNewCerts(a.DB)
+	p := record{ID: id}
+	if err := p.getCertificate(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Certificate not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *Monitor) getCertificateDetail(w http.ResponseWriter, r *http.Request) {
+	p := record{SHA256: strings.ToLower(mux.Vars(r)["sha256"])}
+	if err := p.getCertificateByHash(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Certificate not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		d, err := newCertificateDetail(&p)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, d)
+		return
+	case "pem", "der":
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid format")
+		return
+	}
+	// All that is stored for a precertificate is its TBSCertificate, which
+	// isn't a certificate anything could use
+	if p.Precert {
+		respondWithError(w, http.StatusConflict, "Only the precertificate has been logged")
+		return
+	}
+
+	der, err := certificateDER(&p)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	body, contentType := der, "application/pkix-cert"
+	if format == "pem" {
+		body, contentType = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), "application/x-pem-file"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+p.SHA256+"."+format+"\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
 
+func (a *Monitor) updateCertificate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid certificate ID")
+		return
+	}
+	var u incidentUpdate
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&u); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	p := record{ID: id}
+	if !a.ownCertificate(w, r, &p) {
+		return
+	}
+	if err := p.updateIncident(a.DB, u); err != nil {
 		switch err {
+		case ErrInvalidState:
+			respondWithError(w, http.StatusBadRequest, "Invalid state")
 		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Domain not found")
+			respondWithError(w, http.StatusNotFound, "Certificate not found")
 		default:
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 		}
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, records)
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *Monitor) getKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := getKeys(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (a *Monitor) createKey(w http.ResponseWriter, r *http.Request) {
+	var k apiKey
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&k); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := k.normalize(); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid name or role")
+		return
+	}
+	if err := k.createKey(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, k)
+}
+
+func (a *Monitor) deleteKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid key ID")
+		return
+	}
+
+	k := apiKey{ID: id}
+	if err := k.deleteKey(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Key not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *Monitor) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxAuditLimit {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	entries, err := getAuditLog(a.DB, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+func (a *Monitor) getLogs(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, runner.status())
+}
+
+func (a *Monitor) startLog(w http.ResponseWriter, r *http.Request) {
+	respondWithRunner(w, runner.start(mux.Vars(r)["name"]))
+}
+
+func (a *Monitor) stopLog(w http.ResponseWriter, r *http.Request) {
+	respondWithRunner(w, runner.stop(mux.Vars(r)["name"]))
 }
+
+func respondWithRunner(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	case ErrUnknownLog:
+		respondWithError(w, http.StatusNotFound, "Log not found")
+	case ErrLogRunning:
+		respondWithError(w, http.StatusConflict, "Log already running")
+	case ErrLogStopped:
+		respondWithError(w, http.StatusConflict, "Log already stopped")
+	default:
+		respondWithError(w, http.StatusServiceUnavailable, err.Error())
+	}
+}
+
 func (a *Monitor) initializeRoutes() {
-	a.Router.HandleFunc("/domains", a.getDomains).Methods("GET")
-	a.Router.HandleFunc("/new_certificates", a.getNewCerts).Methods("GET")
-	a.Router.HandleFunc("/domain", a.createDomain).Methods("POST")
-	a.Router.HandleFunc("/domain/{domain:.+}", a.getDomain).Methods("GET")
-	a.Router.HandleFunc("/domain/{domain:.+}", a.deleteDomain).Methods("DELETE")
+	a.Router.HandleFunc("/watchlist", a.authorize(roleReader, a.getWatchlist)).Methods("GET")
+	a.Router.HandleFunc("/watchlist", a.authorize(roleEditor, a.createWatched)).Methods("POST")
+	a.Router.HandleFunc("/watchlist/{id:[0-9]+}", a.authorize(roleReader, a.getWatched)).Methods("GET")
+	a.Router.HandleFunc("/watchlist/{id:[0-9]+}", a.authorize(roleEditor, a.updateWatched)).Methods("PATCH")
+	a.Router.HandleFunc("/watchlist/{id:[0-9]+}", a.authorize(roleEditor, a.deleteWatched)).Methods("DELETE")
+	a.Router.HandleFunc("/domain/{domain}/timeline", a.authorize(roleReader, a.getTimeline)).Methods("GET")
+	a.Router.HandleFunc("/new_certificates", a.authorize(roleReader, a.getNewCerts)).Methods("GET")
+	a.Router.HandleFunc("/backfills", a.authorize(roleReader, a.getBackfills)).Methods("GET")
+	a.Router.HandleFunc("/backfills/{id:[0-9]+}", a.authorize(roleReader, a.getBackfill)).Methods("GET")
+	a.Router.HandleFunc("/acknowledged", a.authorize(roleReader, a.getAcknowledgements)).Methods("GET")
+	a.Router.HandleFunc("/acknowledged", a.authorize(roleEditor, a.createAcknowledgement)).Methods("POST")
+	a.Router.HandleFunc("/certificates", a.authorize(roleReader, a.searchCertificates)).Methods("GET")
+	a.Router.HandleFunc("/certificates/{sha256:[0-9a-fA-F]{64}}", a.authorize(roleReader, a.getCertificateDetail)).Methods("GET")
+	a.Router.HandleFunc("/certificates/{id:[0-9]+}", a.authorize(roleReader, a.getCertificate)).Methods("GET")
+	a.Router.HandleFunc("/certificates/{id:[0-9]+}", a.authorize(roleEditor, a.updateCertificate)).Methods("PATCH")
+	a.Router.HandleFunc("/certificates/{id:[0-9]+}/acknowledge", a.authorize(roleEditor, a.acknowledgeCertificate)).Methods("POST")
+	a.Router.HandleFunc("/keys", a.authorize(roleAdmin, a.getKeys)).Methods("GET")
+	a.Router.HandleFunc("/keys", a.authorize(roleAdmin, a.createKey)).Methods("POST")
+	a.Router.HandleFunc("/keys/{id:[0-9]+}", a.authorize(roleAdmin, a.deleteKey)).Methods("DELETE")
+	a.Router.HandleFunc("/audit", a.authorize(roleAdmin, a.getAuditLog)).Methods("GET")
+	a.Router.HandleFunc("/logs", a.authorize(roleReader, a.getLogs)).Methods("GET")
+	a.Router.HandleFunc("/logs/{name}/start", a.authorize(roleAdmin, a.startLog)).Methods("POST")
+	a.Router.HandleFunc("/logs/{name}/stop", a.authorize(roleAdmin, a.stopLog)).Methods("POST")
 	log.Debugf("Monitor: Initialized routes")
 }
 
-// Initialize the monitor
-func (a *Monitor) Initialize(user, password, dbname string) {
+func openDatabase(user, password, dbname string) (*sql.DB, error) {
 	connectionString := "user='" + user + "' dbname='" + dbname + "' sslmode=disable"
+	return sql.Open("postgres", connectionString)
+}
 
+// Initialize the monitor, bringing the database schema up to date
+func (a *Monitor) Initialize(user, password, dbname string) {
 	var err error
-	a.DB, err = sql.Open("postgres", connectionString)
+	a.DB, err = openDatabase(user, password, dbname)
 	if err != nil {
 		log.Fatalf("Monitor: Couldn't connect to the database: %v", err)
 	}
+	if err = migrate(a.DB, len(migrations)); err != nil {
+		log.Fatalf("Monitor: Couldn't migrate the database: %v", err)
+	}
 
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 }
 
-// Run the monitor
-func (a *Monitor) Run(addr string) {
-	log.Fatal(http.ListenAndServe(addr, a.Router))
+// Run the monitor, over TLS if the configuration has a certificate, until ctx
+// is cancelled. It stops accepting requests then, and returns once those
+// already being served are done.
+func (a *Monitor) Run(ctx context.Context, conf serverConfig) error {
+	server, certs, err := conf.newServer(a.Router)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		timeout, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(timeout); err != nil {
+			log.Noticef("Monitor: Couldn't finish serving requests: %v", err)
+		}
+	}()
+
+	if certs == nil {
+		err = server.ListenAndServe()
+	} else {
+		go certs.reloadOnHangup(ctx)
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
 }
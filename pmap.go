@@ -0,0 +1,185 @@
+// pmap.go
+
+package main
+
+// Each level of a pmap splits on this many bits of the key's hash, and a
+// leaf holds up to pmapBucket keys before it is split
+const (
+	pmapBits   = 4
+	pmapBucket = 8
+)
+
+// pmap is a persistent map from strings: with and without return a new map
+// that shares everything but the path to the changed key with the old one,
+// which is left as it was. Readers can go on using a map while a writer
+// derives the next one from it, and a change costs the same however big the
+// map is. The nil map is empty.
+type pmap struct {
+	root *pmapNode
+	size int
+}
+
+type pmapNode struct {
+	// 1<<pmapBits children, or none if the node is a leaf
+	children []*pmapNode
+	entries  []pmapEntry
+}
+
+type pmapEntry struct {
+	key   string
+	hash  uint64
+	value interface{}
+}
+
+// pmapHash is 64-bit FNV-1a run from the end of the key, so the hash of a
+// key can be carried on from that of one it ends with
+func pmapHash(key string) uint64 {
+	return pmapHashFrom(14695981039346656037, key)
+}
+
+// pmapHashFrom carries on the hash h of some string with prefix before it
+func pmapHashFrom(h uint64, prefix string) uint64 {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		h ^= uint64(prefix[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (m *pmap) len() int {
+	if m == nil {
+		return 0
+	}
+	return m.size
+}
+
+func (m *pmap) get(key string) (interface{}, bool) {
+	return m.getHashed(key, pmapHash(key))
+}
+
+// getHashed looks up a key whose pmapHash is already known
+func (m *pmap) getHashed(key string, h uint64) (interface{}, bool) {
+	if m == nil {
+		return nil, false
+	}
+	n := m.root
+	for shift := uint(0); n != nil; shift += pmapBits {
+		if n.children == nil {
+			for _, e := range n.entries {
+				if e.key == key {
+					return e.value, true
+				}
+			}
+			return nil, false
+		}
+		n = n.children[(h>>shift)&(1<<pmapBits-1)]
+	}
+	return nil, false
+}
+
+// with returns the map with key set to value
+func (m *pmap) with(key string, value interface{}) *pmap {
+	next := &pmap{}
+	if m != nil {
+		*next = *m
+	}
+	var added bool
+	next.root, added = next.root.with(pmapEntry{key, pmapHash(key), value}, 0)
+	if added {
+		next.size++
+	}
+	return next
+}
+
+func (n *pmapNode) with(e pmapEntry, shift uint) (*pmapNode, bool) {
+	if n == nil {
+		return &pmapNode{entries: []pmapEntry{e}}, true
+	}
+	if n.children != nil {
+		i := (e.hash >> shift) & (1<<pmapBits - 1)
+		next := &pmapNode{children: append([]*pmapNode(nil), n.children...)}
+		var added bool
+		next.children[i], added = n.children[i].with(e, shift+pmapBits)
+		return next, added
+	}
+
+	entries := make([]pmapEntry, 0, len(n.entries)+1)
+	added := true
+	for _, old := range n.entries {
+		if old.key == e.key {
+			added = false
+			continue
+		}
+		entries = append(entries, old)
+	}
+	entries = append(entries, e)
+	// Keys whose hashes are all the same can only share a leaf
+	if len(entries) <= pmapBucket || shift >= 64 {
+		return &pmapNode{entries: entries}, added
+	}
+	split := &pmapNode{children: make([]*pmapNode, 1<<pmapBits)}
+	for _, old := range entries {
+		i := (old.hash >> shift) & (1<<pmapBits - 1)
+		split.children[i], _ = split.children[i].with(old, shift+pmapBits)
+	}
+	return split, added
+}
+
+// without returns the map with key removed
+func (m *pmap) without(key string) *pmap {
+	if m == nil {
+		return nil
+	}
+	root, removed := m.root.without(key, pmapHash(key), 0)
+	if !removed {
+		return m
+	}
+	return &pmap{root, m.size - 1}
+}
+
+func (n *pmapNode) without(key string, h uint64, shift uint) (*pmapNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+	if n.children != nil {
+		i := (h >> shift) & (1<<pmapBits - 1)
+		child, removed := n.children[i].without(key, h, shift+pmapBits)
+		if !removed {
+			return n, false
+		}
+		next := &pmapNode{children: append([]*pmapNode(nil), n.children...)}
+		next.children[i] = child
+		return next, true
+	}
+	for i, e := range n.entries {
+		if e.key == key {
+			entries := append(append([]pmapEntry(nil), n.entries[:i]...), n.entries[i+1:]...)
+			return &pmapNode{entries: entries}, true
+		}
+	}
+	return n, false
+}
+
+// each calls fn with every key and value in the map until fn returns false
+func (m *pmap) each(fn func(key string, value interface{}) bool) {
+	if m != nil {
+		m.root.each(fn)
+	}
+}
+
+func (n *pmapNode) each(fn func(key string, value interface{}) bool) bool {
+	if n == nil {
+		return true
+	}
+	for _, e := range n.entries {
+		if !fn(e.key, e.value) {
+			return false
+		}
+	}
+	for _, child := range n.children {
+		if !child.each(fn) {
+			return false
+		}
+	}
+	return true
+}
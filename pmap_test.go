@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPmap(t *testing.T) {
+	var m *pmap
+	if _, ok := m.get("a"); ok || m.len() != 0 {
+		t.Errorf("Expected the nil map to be empty")
+	}
+
+	// Enough keys to split leaves a few levels down
+	versions := []*pmap{m}
+	for i := 0; i < 1000; i++ {
+		m = m.with(strconv.Itoa(i), i)
+		versions = append(versions, m)
+	}
+	m = m.with("7", "seven")
+	if v, _ := m.get("7"); v != "seven" || m.len() != 1000 {
+		t.Errorf("Expected 7 replaced in 1000 keys, got %v in %d", v, m.len())
+	}
+	for i := 0; i < 1000; i += 2 {
+		m = m.without(strconv.Itoa(i))
+	}
+	if m.without("missing") != m {
+		t.Errorf("Expected removing a missing key to leave the map alone")
+	}
+
+	if m.len() != 500 {
+		t.Errorf("Expected 500 keys left, got %d", m.len())
+	}
+	for i := 0; i < 1000; i++ {
+		_, ok := m.get(strconv.Itoa(i))
+		if ok != (i%2 == 1) {
+			t.Errorf("Expected %d present to be %v", i, i%2 == 1)
+		}
+	}
+	seen := 0
+	m.each(func(key string, value interface{}) bool {
+		seen++
+		return true
+	})
+	if seen != 500 {
+		t.Errorf("Expected to visit 500 keys, got %d", seen)
+	}
+
+	// Earlier versions are untouched
+	for i, version := range versions {
+		if version.len() != i {
+			t.Errorf("Expected version %d to keep %d keys, got %d", i, i, version.len())
+		}
+		if i > 0 {
+			if v, ok := version.get(strconv.Itoa(i - 1)); !ok || v != i-1 {
+				t.Errorf("Expected version %d to keep %d, got %v", i, i-1, v)
+			}
+		}
+	}
+	if v, _ := versions[1000].get("7"); v != 7 {
+		t.Errorf("Expected an earlier version to keep its value, got %v", v)
+	}
+}
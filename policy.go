@@ -0,0 +1,57 @@
+// policy.go
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+// Verdicts on a found certificate
+const (
+	verdictExpected  = "expected"
+	verdictViolation = "violation"
+)
+
+var spkiHash = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// issuerAllowed reports whether a certificate comes from one of the allowed
+// issuers, each given as the issuer DN ("CN=..., O=..."), the hex SHA-256 of
+// the SPKI of any certificate in its chain, or a CA name matched against the
+// issuer's organization and common name
+func issuerAllowed(allowed []string, cert *x509.Certificate, chain []*x509.Certificate) bool {
+	dn := distinguishedName(cert.Issuer)
+	for _, issuer := range allowed {
+		switch {
+		case spkiHash.MatchString(issuer):
+			for _, c := range chain {
+				hash := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+				if strings.EqualFold(issuer, hex.EncodeToString(hash[:])) {
+					return true
+				}
+			}
+		case strings.Contains(issuer, "="):
+			if strings.EqualFold(issuer, dn) {
+				return true
+			}
+		default:
+			if containsFold(cert.Issuer.Organization, issuer) || strings.EqualFold(cert.Issuer.CommonName, issuer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classify decides whether a certificate for a watched domain is expected.
+// Look-alikes and certificates for domains without allowed issuers never are.
+func classify(w watchedDomain, reason string, cert *x509.Certificate, chain []*x509.Certificate) string {
+	if reason == reasonWatched && issuerAllowed(w.Issuers, cert, chain) {
+		return verdictExpected
+	}
+	return verdictViolation
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"testing"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+func TestClassify(t *testing.T) {
+	cert := &x509.Certificate{Issuer: pkix.Name{
+		CommonName:   "Let's Encrypt Authority X3",
+		Organization: []string{"Let's Encrypt"},
+		Country:      []string{"US"},
+	}}
+	intermediate := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("intermediate key")}
+	hash := sha256.Sum256(intermediate.RawSubjectPublicKeyInfo)
+	chain := []*x509.Certificate{intermediate}
+
+	cases := []struct {
+		issuers []string
+		reason  string
+		verdict string
+	}{
+		{nil, reasonWatched, verdictViolation},
+		{[]string{"let's encrypt"}, reasonWatched, verdictExpected},
+		{[]string{"DigiCert Inc", "Let's Encrypt Authority X3"}, reasonWatched, verdictExpected},
+		{[]string{"CN=Let's Encrypt Authority X3, O=Let's Encrypt, C=US"}, reasonWatched, verdictExpected},
+		{[]string{"CN=Let's Encrypt Authority X4, O=Let's Encrypt, C=US"}, reasonWatched, verdictViolation},
+		{[]string{hex.EncodeToString(hash[:])}, reasonWatched, verdictExpected},
+		{[]string{"00" + hex.EncodeToString(hash[1:])}, reasonWatched, verdictViolation},
+		{[]string{"Let's Encrypt"}, reasonTypo, verdictViolation},
+	}
+	for _, c := range cases {
+		w := watchedDomain{Domain: "mbernhard.com", Issuers: c.issuers}
+		if verdict := classify(w, c.reason, cert, chain); verdict != c.verdict {
+			t.Errorf("%v (%s): expected %s, got %s", c.issuers, c.reason, c.verdict, verdict)
+		}
+	}
+}
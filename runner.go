@@ -0,0 +1,200 @@
+// runner.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrLogRunning if a log that is already being scanned is started
+var ErrLogRunning = errors.New("Error log is already being scanned")
+
+// ErrLogStopped if a log that isn't being scanned is stopped
+var ErrLogStopped = errors.New("Error log is not being scanned")
+
+// ErrShuttingDown if a log is started while the monitor is shutting down
+var ErrShuttingDown = errors.New("Error shutting down")
+
+// logRunner starts and stops the downloader of each log while the monitor is
+// running. Downloaders send their progress to updates, and the name of a log
+// is sent to idle whenever its downloader stops while the monitor is running:
+// it was stopped through the API or, with -exit, it has scanned all of it.
+type logRunner struct {
+	sync.Mutex
+	ctx      context.Context
+	logs     map[string]*runningLog
+	names    []string
+	updates  chan LogConfig
+	idle     chan string
+	numFetch int
+	numMatch int
+	running  sync.WaitGroup
+	closed   bool
+}
+
+// runningLog is a log and, while it's being scanned, how to stop it
+type runningLog struct {
+	conf    LogConfig
+	matcher Matcher
+	cancel  context.CancelFunc
+	done    chan bool
+}
+
+// logStatus is how far a log has been scanned, and if it's being scanned
+type logStatus struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Index   int64  `json:"index"`
+	Running bool   `json:"running"`
+}
+
+var runner *logRunner
+
+// newLogRunner sets up a downloader for each log, all of them stopping when
+// ctx is cancelled
+func newLogRunner(ctx context.Context, config Configuration, numFetch, numMatch int) (*logRunner, error) {
+	lr := &logRunner{
+		ctx:      ctx,
+		logs:     make(map[string]*runningLog),
+		updates:  make(chan LogConfig),
+		idle:     make(chan string),
+		numFetch: numFetch,
+		numMatch: numMatch,
+	}
+	for _, conf := range config {
+		matcher, err := logMatcher(conf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", conf.Name, err)
+		}
+		lr.logs[conf.Name] = &runningLog{conf: conf, matcher: matcher}
+		lr.names = append(lr.names, conf.Name)
+	}
+	return lr, nil
+}
+
+// startAll starts scanning every log
+func (lr *logRunner) startAll() {
+	for _, name := range lr.names {
+		if err := lr.start(name); err != nil {
+			log.Noticef("Couldn't start %s: %s", name, err)
+		}
+	}
+}
+
+// start scans a log from where it was last stopped
+func (lr *logRunner) start(name string) error {
+	if lr == nil {
+		return ErrUnknownLog
+	}
+	lr.Lock()
+	defer lr.Unlock()
+	l, ok := lr.logs[name]
+	if !ok {
+		return ErrUnknownLog
+	}
+	if l.cancel != nil {
+		return ErrLogRunning
+	}
+	if lr.closed || lr.ctx.Err() != nil {
+		return ErrShuttingDown
+	}
+
+	ctx, cancel := context.WithCancel(lr.ctx)
+	done := make(chan bool)
+	l.cancel, l.done = cancel, done
+	conf := l.conf
+	lr.running.Add(1)
+	go func() {
+		defer lr.running.Done()
+		conf = downloader(ctx, conf, l.matcher, lr.updates, lr.numFetch, lr.numMatch)
+		cancel()
+
+		lr.Lock()
+		l.conf = conf
+		l.cancel, l.done = nil, nil
+		lr.Unlock()
+		close(done)
+
+		select {
+		case lr.idle <- name:
+		case <-lr.ctx.Done():
+		}
+	}()
+	return nil
+}
+
+// stop stops scanning a log, returning once its scan has stopped fetching and
+// processing entries and its progress has been sent
+func (lr *logRunner) stop(name string) error {
+	if lr == nil {
+		return ErrUnknownLog
+	}
+	lr.Lock()
+	l, ok := lr.logs[name]
+	if !ok {
+		lr.Unlock()
+		return ErrUnknownLog
+	}
+	if l.cancel == nil {
+		lr.Unlock()
+		return ErrLogStopped
+	}
+	l.cancel()
+	done := l.done
+	lr.Unlock()
+
+	<-done
+	return nil
+}
+
+// update records how far a log has been scanned
+func (lr *logRunner) update(conf LogConfig) {
+	lr.Lock()
+	defer lr.Unlock()
+	if l, ok := lr.logs[conf.Name]; ok {
+		l.conf = conf
+	}
+}
+
+// anyRunning says if any log is being scanned
+func (lr *logRunner) anyRunning() bool {
+	lr.Lock()
+	defer lr.Unlock()
+	for _, l := range lr.logs {
+		if l.cancel != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (lr *logRunner) status() []logStatus {
+	statuses := make([]logStatus, 0)
+	if lr == nil {
+		return statuses
+	}
+	lr.Lock()
+	defer lr.Unlock()
+	for _, name := range lr.names {
+		l := lr.logs[name]
+		statuses = append(statuses, logStatus{
+			Name:    name,
+			URL:     l.conf.Url,
+			Index:   l.conf.LastIndex,
+			Running: l.cancel != nil,
+		})
+	}
+	return statuses
+}
+
+// wait for every downloader to stop once the runner's context is cancelled.
+// No log can be started after this.
+func (lr *logRunner) wait() {
+	lr.Lock()
+	lr.closed = true
+	lr.Unlock()
+	lr.running.Wait()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLogRunner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := Configuration{{Name: "closed", Url: "http://127.0.0.1:1/", LastIndex: 42, BucketSize: 10}}
+	lr, err := newLogRunner(ctx, config, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for update := range lr.updates {
+			lr.update(update)
+		}
+	}()
+
+	if err := lr.start("closed"); err != nil {
+		t.Fatalf("Couldn't start log: %s", err)
+	}
+	if err := lr.start("closed"); err != ErrLogRunning {
+		t.Errorf("Expected starting a running log to fail, got %v", err)
+	}
+	if status := lr.status(); len(status) != 1 || !status[0].Running || status[0].Index != 42 {
+		t.Errorf("Expected the log to be running from 42, got %v", status)
+	}
+
+	stopped := make(chan error)
+	go func() { stopped <- lr.stop("closed") }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Couldn't stop log: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the log to stop")
+	}
+	if status := lr.status(); status[0].Running || lr.anyRunning() {
+		t.Errorf("Expected the log to be stopped, got %v", status)
+	}
+	select {
+	case name := <-lr.idle:
+		if name != "closed" {
+			t.Errorf("Expected the stopped log to be idle, got %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the stopped log to be reported idle")
+	}
+	if err := lr.stop("closed"); err != ErrLogStopped {
+		t.Errorf("Expected stopping a stopped log to fail, got %v", err)
+	}
+	if err := lr.start("other"); err != ErrUnknownLog {
+		t.Errorf("Expected an unknown log to fail, got %v", err)
+	}
+
+	cancel()
+	lr.wait()
+	if err := lr.start("closed"); err != ErrShuttingDown {
+		t.Errorf("Expected no log to start while shutting down, got %v", err)
+	}
+
+	var none *logRunner
+	if none.start("closed") != ErrUnknownLog || len(none.status()) != 0 {
+		t.Errorf("Expected a missing runner to have no logs")
+	}
+}
+
+func TestCaughtUp(t *testing.T) {
+	var tests = []struct {
+		index, stop, treeSize int64
+		caughtUp              bool
+	}{
+		{99, 0, 100, false},
+		{100, 0, 100, true},
+		{50, 0, 100, false},
+		{50, 50, 100, true},
+		{40, 50, 100, false},
+	}
+	for _, test := range tests {
+		conf := LogConfig{LastIndex: test.index, MaximumIndex: test.stop}
+		if caughtUpWith(conf, test.treeSize) != test.caughtUp {
+			t.Errorf("Expected %d of %d (stop %d) caught up to be %v", test.index, test.treeSize, test.stop, test.caughtUp)
+		}
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	if err := withContext(ctx, func() error { called = true; return nil }); err != context.Canceled || called {
+		t.Errorf("Expected a cancelled context to stop the call, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	release := make(chan bool)
+	defer close(release)
+	if err := withContext(ctx, func() error { <-release; return nil }); err != context.DeadlineExceeded {
+		t.Errorf("Expected to give up on a slow call, got %v", err)
+	}
+}
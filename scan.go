@@ -0,0 +1,302 @@
+// scan.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/zct"
+)
+
+const (
+	// How often entries that couldn't be processed are retried during a scan
+	retryInterval = 30 * time.Second
+	// How long a fetcher waits before asking the log again after an error
+	fetchRetryDelay = 5 * time.Second
+	// How often a scan passes on its progress
+	progressInterval = time.Second
+)
+
+// ErrUnstored if a scan finished with hits it couldn't store
+var ErrUnstored = errors.New("Error certificates found couldn't be stored")
+
+// ErrNoEntries if a log returns no entries for a range inside its tree
+var ErrNoEntries = errors.New("Error log returned no entries")
+
+// entryFetcher is where a scan gets entries from, a *client.LogClient
+type entryFetcher interface {
+	GetEntries(start, end int64) ([]ct.LogEntry, error)
+}
+
+// permanentError is an entry that can never be processed. It is logged and
+// skipped rather than retried.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent marks err as one that retrying won't fix
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// watermark tracks the index a scan of a log can safely carry on from: the
+// first entry that hasn't been processed. Entries are fetched and processed
+// by several workers at once and finish in any order, so each index is marked
+// done on its own and the watermark only moves over a run of done ones.
+// Entries that failed for a reason that may pass are kept to retry, and hold
+// the watermark back until they succeed.
+type watermark struct {
+	mu   sync.Mutex
+	next int64
+	// Indexes after next that are done
+	done map[int64]bool
+	// Entries to process again, by index
+	failed map[int64]*ct.LogEntry
+}
+
+func newWatermark(start int64) *watermark {
+	return &watermark{
+		next:   start,
+		done:   make(map[int64]bool),
+		failed: make(map[int64]*ct.LogEntry),
+	}
+}
+
+// complete marks an index done
+func (wm *watermark) complete(index int64) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	delete(wm.failed, index)
+	if index < wm.next {
+		return
+	}
+	wm.done[index] = true
+	for wm.done[wm.next] {
+		delete(wm.done, wm.next)
+		wm.next++
+	}
+}
+
+// fail keeps an entry to retry
+func (wm *watermark) fail(entry *ct.LogEntry) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	wm.failed[entry.Index] = entry
+}
+
+// level is the index to carry on from
+func (wm *watermark) level() int64 {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	return wm.next
+}
+
+// process runs process on an entry and records how it went, reporting
+// whether the entry is done with
+func (wm *watermark) process(name string, entry *ct.LogEntry, process func(*ct.LogEntry) error) bool {
+	err := process(entry)
+	if err != nil && !isPermanent(err) {
+		wm.fail(entry)
+		return false
+	}
+	if err != nil {
+		log.Warningf("Skipping %s:%d: %s", name, entry.Index, err)
+	}
+	wm.complete(entry.Index)
+	return true
+}
+
+// retry processes the failed entries again, returning how many still fail
+func (wm *watermark) retry(name string, process func(*ct.LogEntry) error) int {
+	wm.mu.Lock()
+	failed := make([]*ct.LogEntry, 0, len(wm.failed))
+	for _, entry := range wm.failed {
+		failed = append(failed, entry)
+	}
+	wm.mu.Unlock()
+
+	remaining := 0
+	for _, entry := range failed {
+		if !wm.process(name, entry, process) {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// logScan is a scan of the entries of a log from start up to end, fetched
+// batchSize at a time by numFetch fetchers and handed to numMatch workers
+type logScan struct {
+	name      string
+	client    entryFetcher
+	start     int64
+	end       int64
+	batchSize int64
+	numFetch  int
+	numMatch  int
+	// process handles an entry, failing with a permanent error if it never
+	// can be
+	process func(*ct.LogEntry) error
+}
+
+// scanLog runs a scan until it finishes or ctx is cancelled, passing the
+// watermark to progress as it moves. It returns the index to carry on from,
+// which is held back to the first entry not processed, so that the next scan
+// from it processes that entry again. Entries that fail are retried every
+// retryInterval while the scan runs, and once more at the end of it; if any
+// still fail the scan returns ErrUnstored. Every fetcher and worker has
+// stopped by the time it returns.
+func scanLog(ctx context.Context, s logScan, progress func(int64)) (int64, error) {
+	if s.batchSize < 1 {
+		s.batchSize = 1
+	}
+	if s.numFetch < 1 {
+		s.numFetch = 1
+	}
+	if s.numMatch < 1 {
+		s.numMatch = 1
+	}
+	wm := newWatermark(s.start)
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ranges := make(chan [2]int64)
+	entries := make(chan *ct.LogEntry, s.batchSize)
+	var fetchers, workers sync.WaitGroup
+	go func() {
+		defer close(ranges)
+		for start := s.start; start < s.end; start += s.batchSize {
+			end := start + s.batchSize
+			if end > s.end {
+				end = s.end
+			}
+			select {
+			case ranges <- [2]int64{start, end}:
+			case <-scanCtx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < s.numFetch; i++ {
+		fetchers.Add(1)
+		go func() {
+			defer fetchers.Done()
+			for r := range ranges {
+				if !s.fetch(scanCtx, r[0], r[1], entries) {
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < s.numMatch; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for entry := range entries {
+				// Entries left queued are processed by the next scan
+				if scanCtx.Err() != nil {
+					continue
+				}
+				wm.process(s.name, entry, s.process)
+			}
+		}()
+	}
+	finished := make(chan bool)
+	go func() {
+		fetchers.Wait()
+		close(entries)
+		workers.Wait()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	retries := time.NewTicker(retryInterval)
+	defer retries.Stop()
+	level := s.start
+	moved := func() {
+		if next := wm.level(); next != level {
+			level = next
+			progress(level)
+		}
+	}
+	for {
+		select {
+		case <-ticker.C:
+			moved()
+		case <-retries.C:
+			wm.retry(s.name, s.process)
+			moved()
+		case <-finished:
+			if ctx.Err() != nil {
+				return wm.level(), ctx.Err()
+			}
+			if remaining := wm.retry(s.name, s.process); remaining > 0 {
+				log.Noticef("%d entries in %s couldn't be processed, carrying on from %d", remaining, s.name, wm.level())
+				return wm.level(), ErrUnstored
+			}
+			return wm.level(), nil
+		case <-ctx.Done():
+			cancel()
+			<-finished
+			return wm.level(), ctx.Err()
+		}
+	}
+}
+
+// fetch gets the entries from start up to end and queues them, asking again
+// after an error, until ctx is cancelled. It reports whether it got them all.
+func (s logScan) fetch(ctx context.Context, start, end int64, entries chan<- *ct.LogEntry) bool {
+	for start < end {
+		var batch []ct.LogEntry
+		err := withContext(ctx, func() (err error) {
+			// The log's range is inclusive
+			batch, err = s.client.GetEntries(start, end-1)
+			return err
+		})
+		if err == nil && len(batch) == 0 {
+			err = ErrNoEntries
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			log.Noticef("Couldn't get %s entries %d-%d, retrying in %s: %s", s.name, start, end-1, fetchRetryDelay, err)
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(fetchRetryDelay):
+			}
+			continue
+		}
+		for i := range batch {
+			if start >= end {
+				break
+			}
+			entry := &batch[i]
+			entry.Index = start
+			select {
+			case entries <- entry:
+			case <-ctx.Done():
+				return false
+			}
+			start++
+		}
+	}
+	return true
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/zct"
+)
+
+func TestWatermark(t *testing.T) {
+	wm := newWatermark(0)
+	failing := map[int64]bool{3: true}
+	process := func(entry *ct.LogEntry) error {
+		switch {
+		case entry.Index == 4:
+			return permanent(errors.New("field too long"))
+		case failing[entry.Index]:
+			return errors.New("database down")
+		}
+		return nil
+	}
+
+	for _, index := range []int64{1, 0, 2, 5} {
+		wm.process("testtube", &ct.LogEntry{Index: index}, process)
+	}
+	if level := wm.level(); level != 3 {
+		t.Errorf("Expected the watermark to move over the done run to 3, got %d", level)
+	}
+
+	wm.process("testtube", &ct.LogEntry{Index: 3}, process)
+	wm.process("testtube", &ct.LogEntry{Index: 4}, process)
+	if level := wm.level(); level != 3 {
+		t.Errorf("Expected the watermark held at the failed entry, got %d", level)
+	}
+	if remaining := wm.retry("testtube", process); remaining != 1 || wm.level() != 3 {
+		t.Errorf("Expected the entry to still fail, got %d remaining at %d", remaining, wm.level())
+	}
+
+	failing[3] = false
+	if remaining := wm.retry("testtube", process); remaining != 0 || wm.level() != 6 {
+		t.Errorf("Expected the retried entry and the skipped one to free the watermark, got %d remaining at %d",
+			remaining, wm.level())
+	}
+}
+
+// fakeLog serves entries from 0 up to size, at most max at a time
+type fakeLog struct {
+	size, max int64
+	// Closed to let GetEntries answer, if set
+	release chan bool
+}
+
+func (l *fakeLog) GetEntries(start, end int64) ([]ct.LogEntry, error) {
+	if l.release != nil {
+		<-l.release
+	}
+	if end >= l.size {
+		end = l.size - 1
+	}
+	if end-start+1 > l.max {
+		end = start + l.max - 1
+	}
+	var entries []ct.LogEntry
+	for i := start; i <= end; i++ {
+		entries = append(entries, ct.LogEntry{Index: i})
+	}
+	return entries, nil
+}
+
+func TestScanLog(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[int64]int)
+	failed := false
+	s := logScan{
+		name:      "testtube",
+		client:    &fakeLog{size: 100, max: 7},
+		start:     10,
+		end:       90,
+		batchSize: 10,
+		numFetch:  3,
+		numMatch:  4,
+		process: func(entry *ct.LogEntry) error {
+			// Later entries finish first
+			time.Sleep(time.Duration(100-entry.Index) * 10 * time.Microsecond)
+			mu.Lock()
+			defer mu.Unlock()
+			seen[entry.Index]++
+			if entry.Index == 50 && !failed {
+				failed = true
+				return errors.New("database down")
+			}
+			if entry.Index == 60 {
+				return permanent(errors.New("field too long"))
+			}
+			return nil
+		},
+	}
+	var levels []int64
+	index, err := scanLog(context.Background(), s, func(level int64) {
+		levels = append(levels, level)
+	})
+	if err != nil || index != 90 {
+		t.Errorf("Expected the scan to reach 90, got %d: %v", index, err)
+	}
+	for i := int64(10); i < 90; i++ {
+		want := 1
+		if i == 50 {
+			want = 2
+		}
+		if seen[i] != want {
+			t.Errorf("Expected entry %d processed %d times, got %d", i, want, seen[i])
+		}
+	}
+	if len(seen) != 80 {
+		t.Errorf("Expected only entries 10 to 89, got %d", len(seen))
+	}
+	for i := 1; i < len(levels); i++ {
+		if levels[i] <= levels[i-1] {
+			t.Errorf("Expected progress to only move forwards, got %v", levels)
+		}
+	}
+}
+
+func TestScanLogCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	done := make(map[int64]bool)
+	started := make(chan bool)
+	release := make(chan bool)
+	s := logScan{
+		name:      "testtube",
+		client:    &fakeLog{size: 100, max: 100},
+		start:     0,
+		end:       100,
+		batchSize: 20,
+		numFetch:  2,
+		numMatch:  2,
+		process: func(entry *ct.LogEntry) error {
+			if entry.Index == 3 {
+				// Held until the scan is cancelled, with later entries
+				// done or still queued behind it
+				close(started)
+				<-release
+			}
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			done[entry.Index] = true
+			return nil
+		},
+	}
+
+	result := make(chan int64)
+	go func() {
+		index, err := scanLog(ctx, s, func(int64) {})
+		if err != context.Canceled {
+			t.Errorf("Expected the scan to be cancelled, got %v", err)
+		}
+		result <- index
+	}()
+	<-started
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	close(release)
+	index := <-result
+
+	mu.Lock()
+	defer mu.Unlock()
+	if index <= 3 || index >= 100 || done[index] {
+		t.Errorf("Expected to carry on from the first entry not done, past the one held, got %d", index)
+	}
+	for i := int64(0); i < index; i++ {
+		if !done[i] {
+			t.Errorf("Expected entry %d before the watermark to be done", i)
+		}
+	}
+}
+
+func TestScanLogStopWaits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var done []int64
+	held := make(chan bool, 2)
+	release := make(chan bool)
+	s := logScan{
+		name:      "testtube",
+		client:    &fakeLog{size: 100, max: 100},
+		start:     0,
+		end:       100,
+		batchSize: 50,
+		numMatch:  2,
+		process: func(entry *ct.LogEntry) error {
+			held <- true
+			<-release
+			mu.Lock()
+			defer mu.Unlock()
+			done = append(done, entry.Index)
+			return nil
+		},
+	}
+
+	result := make(chan int64)
+	go func() {
+		index, _ := scanLog(ctx, s, func(int64) {})
+		result <- index
+	}()
+	// Both workers are busy, with the rest of the entries queued
+	<-held
+	<-held
+	cancel()
+	select {
+	case <-result:
+		t.Fatalf("Expected the scan to wait for the entries being processed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	index := <-result
+
+	mu.Lock()
+	count := len(done)
+	mu.Unlock()
+	if count != 2 || index != 2 {
+		t.Errorf("Expected the two entries being processed to count and no others, got %d done and index %d",
+			count, index)
+	}
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(done) != count {
+		t.Errorf("Expected nothing to be processed once the scan returned, got %v", done)
+	}
+}
+
+func TestScanLogCancelFetch(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan bool)
+	s := logScan{
+		name:      "testtube",
+		client:    &fakeLog{size: 100, max: 100, release: release},
+		start:     0,
+		end:       100,
+		batchSize: 10,
+		numFetch:  4,
+		numMatch:  4,
+		process: func(entry *ct.LogEntry) error {
+			t.Errorf("Expected no entries, got %d", entry.Index)
+			return nil
+		},
+	}
+
+	result := make(chan int64)
+	go func() {
+		index, _ := scanLog(ctx, s, func(int64) {})
+		result <- index
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case index := <-result:
+		if index != 0 {
+			t.Errorf("Expected to carry on from the start, got %d", index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the scan to stop while the log was still answering")
+	}
+
+	// The abandoned requests finish once the log answers, and nothing is left
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Expected the scan's goroutines to exit, %d left of %d", n, before)
+	}
+}
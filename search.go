@@ -0,0 +1,244 @@
+// search.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of a certificate search
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// Timestamps a search can be sorted and ranged on, and how to read each back
+// from a record for the cursor
+var searchSorts = map[string]func(r *record) string{
+	"created_at":       func(r *record) string { return r.Created },
+	"updated_at":       func(r *record) string { return r.Updated },
+	"state_changed_at": func(r *record) string { return r.StateChanged },
+	"not_before":       func(r *record) string { return r.NotBefore.Format(time.RFC3339Nano) },
+	"not_after":        func(r *record) string { return r.NotAfter.Format(time.RFC3339Nano) },
+}
+
+// certificateQuery is a page of a certificate search. Domain uses the same
+// syntax as watched domains, matched against every name on a certificate.
+type certificateQuery struct {
+	Domain    string
+	Issuer    string
+	Log       string
+	Precert   *bool
+	Valid     *bool
+	State     string
+	Verdict   string
+	Since     time.Time
+	Until     time.Time
+	Sort      string
+	Ascending bool
+	Limit     int
+	// Where the previous page ended
+	afterTime string
+	afterID   int64
+}
+
+// searchResult is a page of certificates and the cursor of the next page, if
+// there is one
+type searchResult struct {
+	Certificates []record `json:"certificates"`
+	Next         string   `json:"next,omitempty"`
+}
+
+// parseCertificateQuery reads a search from request parameters
+func parseCertificateQuery(values url.Values) (certificateQuery, error) {
+	q := certificateQuery{
+		Domain:  values.Get("domain"),
+		Issuer:  values.Get("issuer"),
+		Log:     values.Get("log"),
+		State:   values.Get("state"),
+		Verdict: values.Get("verdict"),
+		Sort:    "created_at",
+		Limit:   defaultSearchLimit,
+	}
+	if q.Domain != "" && parsePattern(q.Domain).name == "" {
+		return q, errors.New("Invalid domain")
+	}
+	if q.State != "" && !incidentStates[q.State] {
+		return q, errors.New("Invalid state")
+	}
+
+	for name, dest := range map[string]**bool{"precert": &q.Precert, "valid": &q.Valid} {
+		if value := values.Get(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return q, errors.New("Invalid " + name)
+			}
+			*dest = &b
+		}
+	}
+	for name, dest := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := values.Get(name); value != "" {
+			t, err := parseSearchTime(value)
+			if err != nil {
+				return q, errors.New("Invalid " + name)
+			}
+			*dest = t
+		}
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		if _, ok := searchSorts[sort]; !ok {
+			return q, errors.New("Invalid sort")
+		}
+		q.Sort = sort
+	}
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		return q, errors.New("Invalid order")
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			return q, errors.New("Invalid limit")
+		}
+		q.Limit = limit
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		if err := q.decodeCursor(cursor); err != nil {
+			return q, errors.New("Invalid cursor")
+		}
+	}
+	return q, nil
+}
+
+// parseSearchTime takes either a date or an RFC 3339 time
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// The cursor is the sort timestamp and ID of the last certificate on a page.
+// Which sort it belongs to is part of it, so it can't be used with another.
+func encodeCursor(sort, value string, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sort + "," + value + "," + strconv.FormatInt(id, 10)))
+}
+
+func (q *certificateQuery) decodeCursor(cursor string) error {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(string(raw), ",")
+	if len(parts) != 3 || parts[0] != q.Sort {
+		return errors.New("cursor doesn't match the sort")
+	}
+	if _, err := time.Parse(time.RFC3339Nano, parts[1]); err != nil {
+		return err
+	}
+	if q.afterID, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return err
+	}
+	q.afterTime = parts[1]
+	return nil
+}
+
+// search runs the query, returning one page of certificates
+func (q certificateQuery) search(db *sql.DB) (searchResult, error) {
+	var where []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if q.Domain != "" {
+		p := parsePattern(q.Domain)
+		like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(p.name)
+		var match string
+		switch p.kind {
+		case patternExact:
+			match = "n.name = " + arg(p.name)
+		case patternWildcard:
+			match = "(n.name LIKE " + arg("%."+like) + " AND n.name NOT LIKE " + arg("%.%."+like) + ")"
+		default:
+			match = "(n.name = " + arg(p.name) + " OR n.name LIKE " + arg("%."+like) + ")"
+		}
+		where = append(where, "EXISTS (SELECT 1 FROM certificate_names n WHERE n.certificate_id = c.id AND "+match+")")
+	}
+	if q.Issuer != "" {
+		like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q.Issuer)
+		where = append(where, "c.issuer ILIKE "+arg("%"+like+"%"))
+	}
+	if q.Log != "" {
+		where = append(where, "EXISTS (SELECT 1 FROM certificate_sightings s WHERE s.certificate_id = c.id AND s.log_name = "+arg(q.Log)+")")
+	}
+	if q.Precert != nil {
+		where = append(where, "c.precert = "+arg(*q.Precert))
+	}
+	if q.Valid != nil {
+		where = append(where, "c.valid = "+arg(*q.Valid))
+	}
+	if q.State != "" {
+		where = append(where, "c.state = "+arg(q.State))
+	}
+	if q.Verdict != "" {
+		where = append(where, "c.verdict = "+arg(q.Verdict))
+	}
+
+	column := "c." + q.Sort
+	if !q.Since.IsZero() {
+		where = append(where, column+" >= "+arg(q.Since))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, column+" < "+arg(q.Until))
+	}
+	order, compare := "DESC", "<"
+	if q.Ascending {
+		order, compare = "ASC", ">"
+	}
+	if q.afterTime != "" {
+		where = append(where, "("+column+", c.id) "+compare+" ("+arg(q.afterTime)+"::timestamp, "+arg(q.afterID)+")")
+	}
+
+	query := "SELECT " + recordColumns + " FROM certificates c"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY " + column + " " + order + ", c.id " + order + " LIMIT " + arg(q.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return searchResult{}, err
+	}
+	defer rows.Close()
+
+	result := searchResult{Certificates: make([]record, 0)}
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return result, err
+		}
+		result.Certificates = append(result.Certificates, r)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	if len(result.Certificates) > q.Limit {
+		result.Certificates = result.Certificates[:q.Limit]
+		last := &result.Certificates[q.Limit-1]
+		result.Next = encodeCursor(q.Sort, searchSorts[q.Sort](last), last.ID)
+	}
+	return result, getSightings(db, result.Certificates)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseCertificateQuery(t *testing.T) {
+	q, err := parseCertificateQuery(url.Values{
+		"domain":  {"=mbernhard.com"},
+		"precert": {"false"},
+		"since":   {"2018-03-01"},
+		"sort":    {"not_after"},
+		"order":   {"asc"},
+		"limit":   {"20"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if q.Precert == nil || *q.Precert || q.Valid != nil || q.Since.Month() != 3 || q.Sort != "not_after" || !q.Ascending || q.Limit != 20 {
+		t.Errorf("Parsed the wrong query: %+v", q)
+	}
+
+	bad := []url.Values{
+		{"domain": {"=."}},
+		{"state": {"closed"}},
+		{"valid": {"maybe"}},
+		{"until": {"yesterday"}},
+		{"sort": {"id"}},
+		{"order": {"up"}},
+		{"limit": {"0"}},
+		{"limit": {"501"}},
+		{"cursor": {"!!"}},
+		{"cursor": {encodeCursor("created_at", "2018-03-01T00:00:00Z", 7)}, "sort": {"not_after"}},
+	}
+	for _, values := range bad {
+		if _, err := parseCertificateQuery(values); err == nil {
+			t.Errorf("Expected an error parsing %v", values)
+		}
+	}
+}
+
+func TestSearchCursor(t *testing.T) {
+	cursor := encodeCursor("created_at", "2018-03-01T12:00:00.123456Z", 42)
+	q, err := parseCertificateQuery(url.Values{"cursor": {cursor}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if q.afterTime != "2018-03-01T12:00:00.123456Z" || q.afterID != 42 {
+		t.Errorf("Expected to continue after 42 at 2018-03-01T12:00:00.123456Z, got %d at %s", q.afterID, q.afterTime)
+	}
+}
@@ -0,0 +1,138 @@
+// server.go
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long in-flight API requests get to finish when shutting down
+const shutdownTimeout = 30 * time.Second
+
+// ErrClientCA if the client CA file has no certificates in it
+var ErrClientCA = errors.New("Error no certificates in client CA file")
+
+// ErrClientCAWithoutTLS if client certificates are asked for without TLS
+var ErrClientCAWithoutTLS = errors.New("Error client CA file needs a TLS certificate and key")
+
+// serverConfig is how the API is served. It's served over TLS if CertFile and
+// KeyFile are set, and only to clients with a certificate from ClientCAFile if
+// that is set too.
+type serverConfig struct {
+	Addr         string
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+// certReloader serves a certificate that can be reloaded from disk while the
+// server is running
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	return c, c.reload()
+}
+
+// reload reads the certificate and key again, keeping the old ones if they
+// can't be read
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// reloadOnHangup reloads the certificate each time the process gets a SIGHUP,
+// until ctx is cancelled
+func (c *certReloader) reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if err := c.reload(); err != nil {
+			log.Errorf("Couldn't reload TLS certificate, keeping the old one: %s", err)
+			continue
+		}
+		log.Noticef("Reloaded TLS certificate from %s", c.certFile)
+	}
+}
+
+// tlsConfig sets up TLS for the server, nil if it's served in the clear
+func (conf serverConfig) tlsConfig() (*tls.Config, *certReloader, error) {
+	if conf.CertFile == "" && conf.KeyFile == "" {
+		if conf.ClientCAFile != "" {
+			return nil, nil, ErrClientCAWithoutTLS
+		}
+		return nil, nil, nil
+	}
+	certs, err := newCertReloader(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, ErrClientCA
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, certs, nil
+}
+
+// newServer makes the HTTP server for the API
+func (conf serverConfig) newServer(handler http.Handler) (*http.Server, *certReloader, error) {
+	config, certs, err := conf.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &http.Server{
+		Addr:         conf.Addr,
+		Handler:      handler,
+		TLSConfig:    config,
+		ReadTimeout:  conf.ReadTimeout,
+		WriteTimeout: conf.WriteTimeout,
+		IdleTimeout:  conf.IdleTimeout,
+	}, certs, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for name and its key
+func writeKeyPair(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func servedName(t *testing.T, c *certReloader) string {
+	cert, err := c.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeKeyPair(t, dir, "old.example.com")
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Couldn't load certificate: %s", err)
+	}
+	if name := servedName(t, c); name != "old.example.com" {
+		t.Errorf("Expected old.example.com, got %s", name)
+	}
+
+	writeKeyPair(t, dir, "new.example.com")
+	if err := c.reload(); err != nil {
+		t.Fatalf("Couldn't reload certificate: %s", err)
+	}
+	if name := servedName(t, c); name != "new.example.com" {
+		t.Errorf("Expected new.example.com after reloading, got %s", name)
+	}
+
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	if err := c.reload(); err == nil {
+		t.Errorf("Expected an error reloading a broken key")
+	}
+	if name := servedName(t, c); name != "new.example.com" {
+		t.Errorf("Expected to keep new.example.com after a failed reload, got %s", name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan bool)
+	go func() {
+		c.reloadOnHangup(ctx)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected reloading on SIGHUP to stop with its context")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeKeyPair(t, dir, "api.example.com")
+
+	config, certs, err := serverConfig{}.tlsConfig()
+	if config != nil || certs != nil || err != nil {
+		t.Errorf("Expected no TLS without a certificate")
+	}
+	if _, _, err := (serverConfig{ClientCAFile: certFile}).tlsConfig(); err != ErrClientCAWithoutTLS {
+		t.Errorf("Expected client certificates to need TLS, got %v", err)
+	}
+
+	config, _, err = serverConfig{CertFile: certFile, KeyFile: keyFile}.tlsConfig()
+	if err != nil || config.ClientAuth != tls.NoClientCert || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected TLS without client certificates, got %v", err)
+	}
+
+	config, _, err = serverConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}.tlsConfig()
+	if err != nil || config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Errorf("Expected client certificates to be required, got %v", err)
+	}
+	if _, _, err := (serverConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}).tlsConfig(); err != ErrClientCA {
+		t.Errorf("Expected a client CA file without certificates to be refused, got %v", err)
+	}
+}
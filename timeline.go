@@ -0,0 +1,153 @@
+// timeline.go
+
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// timeline is every certificate covering a name, by notBefore
+type timeline struct {
+	Domain       string          `json:"domain"`
+	Certificates []timelineEntry `json:"certificates"`
+	Stats        timelineStats   `json:"stats"`
+}
+
+// timelineEntry is a certificate on a timeline and how it follows on from the
+// ones before it. Overlap and Gap are in days: how long the certificate was
+// valid alongside an earlier one, or how long nothing was valid before it.
+type timelineEntry struct {
+	ID            int64     `json:"id"`
+	SHA256        string    `json:"sha256"`
+	Serial        string    `json:"serial"`
+	Issuer        string    `json:"issuer"`
+	Names         []string  `json:"names"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	Precert       bool      `json:"precert"`
+	Verdict       string    `json:"verdict"`
+	State         string    `json:"state"`
+	IssuerChanged bool      `json:"issuer_changed"`
+	Overlap       float64   `json:"overlap_days"`
+	Gap           float64   `json:"gap_days"`
+}
+
+// timelineStats sums up the renewal cadence of a name, in days
+type timelineStats struct {
+	Certificates  int      `json:"certificates"`
+	Issuers       []string `json:"issuers"`
+	IssuerChanges int      `json:"issuer_changes"`
+	Gaps          int      `json:"gaps"`
+	GapDays       float64  `json:"gap_days"`
+	MeanLifetime  float64  `json:"mean_lifetime_days"`
+	Renewals      int      `json:"renewals"`
+	MinRenewal    float64  `json:"min_renewal_days"`
+	MaxRenewal    float64  `json:"max_renewal_days"`
+	MeanRenewal   float64  `json:"mean_renewal_days"`
+	MedianRenewal float64  `json:"median_renewal_days"`
+}
+
+// getTimelineRecords reads the certificates valid for a name, including
+// wildcards covering it, by notBefore
+func getTimelineRecords(db *sql.DB, name string) ([]record, error) {
+	rows, err := db.Query(
+		`SELECT `+recordColumns+` FROM certificates c WHERE EXISTS (
+			SELECT 1 FROM certificate_names n WHERE n.certificate_id = c.id AND (n.name = $1 OR n.name = $2))
+		ORDER BY c.not_before, c.id`, name, "*."+parentDomain(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]record, 0)
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// buildTimeline lays out certificates sorted by notBefore
+func buildTimeline(domain string, records []record) timeline {
+	t := timeline{Domain: domain, Certificates: make([]timelineEntry, 0, len(records))}
+	t.Stats.Issuers = make([]string, 0)
+	seenIssuer := make(map[string]bool)
+	var renewals []float64
+	var lifetimes float64
+	var covered time.Time
+
+	for i, r := range records {
+		e := timelineEntry{
+			ID:        r.ID,
+			SHA256:    r.SHA256,
+			Serial:    r.Serial,
+			Issuer:    r.Issuer,
+			Names:     r.Names,
+			NotBefore: r.NotBefore,
+			NotAfter:  r.NotAfter,
+			Precert:   r.Precert,
+			Verdict:   r.Verdict,
+			State:     r.State,
+		}
+		if !seenIssuer[r.Issuer] {
+			seenIssuer[r.Issuer] = true
+			t.Stats.Issuers = append(t.Stats.Issuers, r.Issuer)
+		}
+		lifetimes += days(r.NotAfter.Sub(r.NotBefore))
+
+		if i > 0 {
+			prev := records[i-1]
+			if prev.Issuer != r.Issuer {
+				e.IssuerChanged = true
+				t.Stats.IssuerChanges++
+			}
+			renewals = append(renewals, days(r.NotBefore.Sub(prev.NotBefore)))
+			if r.NotBefore.After(covered) {
+				e.Gap = days(r.NotBefore.Sub(covered))
+				t.Stats.Gaps++
+				t.Stats.GapDays += e.Gap
+			} else {
+				end := covered
+				if r.NotAfter.Before(end) {
+					end = r.NotAfter
+				}
+				e.Overlap = days(end.Sub(r.NotBefore))
+			}
+		}
+		if r.NotAfter.After(covered) {
+			covered = r.NotAfter
+		}
+		t.Certificates = append(t.Certificates, e)
+	}
+
+	t.Stats.Certificates = len(records)
+	if len(records) > 0 {
+		t.Stats.MeanLifetime = lifetimes / float64(len(records))
+	}
+	t.Stats.Renewals = len(renewals)
+	if len(renewals) > 0 {
+		sort.Float64s(renewals)
+		var total float64
+		for _, r := range renewals {
+			total += r
+		}
+		t.Stats.MinRenewal = renewals[0]
+		t.Stats.MaxRenewal = renewals[len(renewals)-1]
+		t.Stats.MeanRenewal = total / float64(len(renewals))
+		mid := len(renewals) / 2
+		t.Stats.MedianRenewal = renewals[mid]
+		if len(renewals)%2 == 0 {
+			t.Stats.MedianRenewal = (renewals[mid-1] + renewals[mid]) / 2
+		}
+	}
+	return t
+}
+
+func days(d time.Duration) float64 {
+	return d.Hours() / 24
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildTimeline(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(days int) time.Time { return start.AddDate(0, 0, days) }
+	records := []record{
+		{ID: 1, Issuer: "CN=GeoTrust DV SSL CA", NotBefore: at(0), NotAfter: at(90)},
+		{ID: 2, Issuer: "CN=GeoTrust DV SSL CA", NotBefore: at(60), NotAfter: at(150)},
+		{ID: 3, Issuer: "CN=Let's Encrypt Authority X3", NotBefore: at(160), NotAfter: at(250)},
+		{ID: 4, Issuer: "CN=Let's Encrypt Authority X3", NotBefore: at(220), NotAfter: at(310)},
+	}
+	tl := buildTimeline("mbernhard.com", records)
+
+	cases := []struct {
+		changed      bool
+		overlap, gap float64
+	}{
+		{false, 0, 0},
+		{false, 30, 0},
+		{true, 0, 10},
+		{false, 30, 0},
+	}
+	for i, c := range cases {
+		e := tl.Certificates[i]
+		if e.IssuerChanged != c.changed || e.Overlap != c.overlap || e.Gap != c.gap {
+			t.Errorf("Certificate %d: expected changed %v, overlap %v, gap %v, got %v, %v, %v",
+				e.ID, c.changed, c.overlap, c.gap, e.IssuerChanged, e.Overlap, e.Gap)
+		}
+	}
+
+	s := tl.Stats
+	if s.Certificates != 4 || len(s.Issuers) != 2 || s.IssuerChanges != 1 || s.Gaps != 1 || s.GapDays != 10 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	if s.Renewals != 3 || s.MinRenewal != 60 || s.MaxRenewal != 100 || s.MedianRenewal != 60 || s.MeanLifetime != 90 {
+		t.Errorf("Unexpected renewal cadence %+v", s)
+	}
+
+	if empty := buildTimeline("mbernhard.com", nil); empty.Stats.Certificates != 0 || len(empty.Certificates) != 0 {
+		t.Errorf("Expected an empty timeline, got %+v", empty)
+	}
+}
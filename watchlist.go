@@ -0,0 +1,250 @@
+// watchlist.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// watchlist holds the watched domains of every log. Scanner workers read an
+// immutable snapshot of the indexes without locking; writers derive a new
+// snapshot from the current one and swap it in.
+type watchlist struct {
+	// Serialises writers
+	sync.Mutex
+	// Every log we scan, so domains watched in all logs reach each of them
+	logs []string
+	// The watched domains by ID
+	domains  map[int64]watchedDomain
+	snapshot atomic.Value
+}
+
+// watchSnapshot is what readers of a watchlist see, keyed by log name
+type watchSnapshot struct {
+	indexes map[string]*domainIndex
+	// The []watchedDomain behind each name in each log's index, the first
+	// being the one a name is attributed to
+	domains map[string]*pmap
+}
+
+var hostnames = newWatchlist(nil)
+
+func newWatchlist(logs []string) *watchlist {
+	wl := &watchlist{logs: logs, domains: make(map[int64]watchedDomain)}
+	wl.snapshot.Store(&watchSnapshot{})
+	return wl
+}
+
+// index returns the current index of domains watched in a log. It must not
+// be modified.
+func (wl *watchlist) index(server string) *domainIndex {
+	return wl.snapshot.Load().(*watchSnapshot).indexes[server]
+}
+
+// watched returns the watched domain in a log that a name from its index, or
+// a look-alike brand, came from
+func (wl *watchlist) watched(server, name string) (watchedDomain, bool) {
+	v, ok := wl.snapshot.Load().(*watchSnapshot).domains[server].get(parsePattern(name).name)
+	if !ok {
+		return watchedDomain{}, false
+	}
+	return v.([]watchedDomain)[0], true
+}
+
+// setLogs sets the logs that domains watched in every log apply to
+func (wl *watchlist) setLogs(logs []string) {
+	wl.Lock()
+	defer wl.Unlock()
+	wl.logs = logs
+	wl.publish()
+}
+
+// add starts matching a newly watched domain, or updates one already watched
+// in place, attributing names as publish would
+func (wl *watchlist) add(w watchedDomain) {
+	wl.Lock()
+	defer wl.Unlock()
+	snapshot := wl.snapshot.Load().(*watchSnapshot)
+	if old, ok := wl.domains[w.ID]; ok {
+		snapshot = snapshot.without(old, wl.logs)
+	}
+	wl.domains[w.ID] = w
+	wl.snapshot.Store(snapshot.with(w, wl.logs))
+}
+
+// remove stops matching a watched domain
+func (wl *watchlist) remove(id int64) {
+	wl.Lock()
+	defer wl.Unlock()
+	if old, ok := wl.domains[id]; ok {
+		delete(wl.domains, id)
+		wl.snapshot.Store(wl.snapshot.Load().(*watchSnapshot).without(old, wl.logs))
+	}
+}
+
+// replace swaps the watched domains for a new list
+func (wl *watchlist) replace(domains []watchedDomain) {
+	wl.Lock()
+	defer wl.Unlock()
+	wl.set(domains)
+}
+
+// set replaces the watched domains and publishes them. The caller must hold
+// the lock.
+func (wl *watchlist) set(domains []watchedDomain) {
+	wl.domains = make(map[int64]watchedDomain, len(domains))
+	for _, w := range domains {
+		wl.domains[w.ID] = w
+	}
+	wl.publish()
+}
+
+// publish builds new indexes from scratch and makes them visible to readers.
+// Names are attributed to the earliest domain watched for them. The caller
+// must hold the lock.
+func (wl *watchlist) publish() {
+	domains := make([]watchedDomain, 0, len(wl.domains))
+	for _, w := range wl.domains {
+		domains = append(domains, w)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].ID < domains[j].ID })
+	snapshot := &watchSnapshot{}
+	for _, w := range domains {
+		snapshot = snapshot.with(w, wl.logs)
+	}
+	wl.snapshot.Store(snapshot)
+}
+
+// servers returns the logs a domain is watched in
+func (w watchedDomain) servers(logs []string) []string {
+	if w.CTServer == "" {
+		return logs
+	}
+	return []string{w.CTServer}
+}
+
+// with returns a snapshot that also watches w. Only the indexes of the logs
+// w is watched in change, and then only along the paths to its entries.
+func (s *watchSnapshot) with(w watchedDomain, logs []string) *watchSnapshot {
+	next := s.copy()
+	for _, server := range w.servers(logs) {
+		idx := next.indexes[server]
+		if idx == nil {
+			idx = newDomainIndex(nil)
+		}
+		next.indexes[server] = idx.with(w.pattern())
+
+		var domains []watchedDomain
+		if v, ok := next.domains[server].get(w.Domain); ok {
+			domains = v.([]watchedDomain)
+		}
+		// Kept in ID order, as publish would build them
+		i := sort.Search(len(domains), func(i int) bool { return domains[i].ID > w.ID })
+		list := make([]watchedDomain, 0, len(domains)+1)
+		list = append(append(append(list, domains[:i]...), w), domains[i:]...)
+		next.domains[server] = next.domains[server].with(w.Domain, list)
+	}
+	return next
+}
+
+// without returns a snapshot that no longer watches w
+func (s *watchSnapshot) without(w watchedDomain, logs []string) *watchSnapshot {
+	next := s.copy()
+	for _, server := range w.servers(logs) {
+		if idx := next.indexes[server]; idx != nil {
+			next.indexes[server] = idx.without(w.pattern())
+		}
+
+		v, ok := next.domains[server].get(w.Domain)
+		if !ok {
+			continue
+		}
+		var domains []watchedDomain
+		for _, d := range v.([]watchedDomain) {
+			if d.ID != w.ID {
+				domains = append(domains, d)
+			}
+		}
+		if len(domains) == 0 {
+			next.domains[server] = next.domains[server].without(w.Domain)
+		} else {
+			next.domains[server] = next.domains[server].with(w.Domain, domains)
+		}
+	}
+	return next
+}
+
+// copy makes a shallow copy of the snapshot's maps, which have an entry for
+// each log
+func (s *watchSnapshot) copy() *watchSnapshot {
+	next := &watchSnapshot{
+		indexes: make(map[string]*domainIndex, len(s.indexes)),
+		domains: make(map[string]*pmap, len(s.domains)),
+	}
+	for server, idx := range s.indexes {
+		next.indexes[server] = idx
+	}
+	for server, domains := range s.domains {
+		next.domains[server] = domains
+	}
+	return next
+}
+
+// load replaces the watched domains with those in the database
+func (wl *watchlist) load(db *sql.DB) error {
+	// Holding the lock over the query keeps a domain added meanwhile from
+	// being dropped by a stale list
+	wl.Lock()
+	defer wl.Unlock()
+	domains, err := getWatchedDomains(db, "", "")
+	if err != nil {
+		return err
+	}
+	wl.set(domains)
+	return nil
+}
+
+// refresh reloads the watched domains every period, so domains added through
+// another instance are picked up
+func (wl *watchlist) refresh(ctx context.Context, db *sql.DB, period time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(period):
+		}
+		if err := wl.load(db); err != nil {
+			log.Noticef("Couldn't reload watched domains: %s", err)
+		}
+	}
+}
+
+// importHostnames adds the hostnames listed in the configuration file to the
+// watched domains in the database, which is where they are read from
+func importHostnames(db *sql.DB, config Configuration) error {
+	for _, conf := range config {
+		for _, hostname := range conf.HostNames {
+			w := watchedDomain{Domain: hostname, CTServer: conf.Name, Issuers: conf.Issuers[hostname]}
+			if err := w.normalize(); err != nil {
+				log.Warningf("Ignoring hostname %q for %s: %s", hostname, conf.Name, err)
+				continue
+			}
+			_, err := db.Exec(
+				`INSERT INTO watched_domains(domain, pattern_type, log_name, allowed_issuers)
+				VALUES($1, $2, $3, $4)
+				ON CONFLICT (domain, pattern_type, log_name) DO UPDATE SET `+updateIssuers,
+				w.Domain, w.Type, w.CTServer, pq.Array(w.Issuers))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
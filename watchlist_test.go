@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zmap/zgrab/ztools/zct/x509"
+)
+
+func TestWatchedDomainNormalize(t *testing.T) {
+	cases := []struct {
+		in      watchedDomain
+		domain  string
+		kind    string
+		pattern string
+	}{
+		{watchedDomain{Domain: "MBernhard.com."}, "mbernhard.com", "suffix", "mbernhard.com"},
+		{watchedDomain{Domain: "*.imsg.com"}, "imsg.com", "wildcard", "*.imsg.com"},
+		{watchedDomain{Domain: "=inssec.org"}, "inssec.org", "exact", "=inssec.org"},
+		{watchedDomain{Domain: "inssec.org", Type: "exact"}, "inssec.org", "exact", "=inssec.org"},
+	}
+	for _, c := range cases {
+		w := c.in
+		if err := w.normalize(); err != nil {
+			t.Errorf("Couldn't normalize %v: %s", c.in, err)
+			continue
+		}
+		if w.Domain != c.domain || w.Type != c.kind || w.pattern() != c.pattern {
+			t.Errorf("%v: expected %s %s %s, got %s %s %s", c.in, c.domain, c.kind, c.pattern, w.Domain, w.Type, w.pattern())
+		}
+	}
+
+	for _, w := range []watchedDomain{{Domain: ""}, {Domain: "=."}, {Domain: "a.com", Type: "prefix"}, {Domain: "exa mple.com"}, {Domain: "-a.com"}, {Domain: "a..com"}} {
+		if err := w.normalize(); err == nil {
+			t.Errorf("Expected an error normalizing %v", w)
+		}
+	}
+}
+
+func TestWatchlistLogs(t *testing.T) {
+	wl := newWatchlist([]string{"pilot", "rocketeer"})
+	wl.replace([]watchedDomain{
+		{ID: 1, Domain: "mbernhard.com", Type: "suffix"},
+		{ID: 2, Domain: "imsg.com", Type: "wildcard", CTServer: "pilot"},
+	})
+
+	if _, ok := wl.index("rocketeer").lookup("mail.mbernhard.com"); !ok {
+		t.Errorf("Expected a domain watched in every log to be watched in rocketeer")
+	}
+	if _, ok := wl.index("pilot").lookup("a.imsg.com"); !ok {
+		t.Errorf("Expected a domain watched in pilot to be watched there")
+	}
+	if _, ok := wl.index("rocketeer").lookup("a.imsg.com"); ok {
+		t.Errorf("Expected a domain watched in pilot not to be watched in rocketeer")
+	}
+	if wl.index("argon") != nil {
+		t.Errorf("Expected no index for a log we don't scan")
+	}
+}
+
+func TestWatchlistUpdates(t *testing.T) {
+	wl := newWatchlist([]string{"pilot", "rocketeer"})
+	wl.add(watchedDomain{ID: 1, Domain: "mbernhard.com", Type: "suffix", Owner: "web"})
+	wl.add(watchedDomain{ID: 2, Domain: "mbernhard.com", Type: "suffix", Owner: "mail", CTServer: "pilot"})
+	before := wl.index("pilot")
+
+	if w, ok := wl.watched("pilot", "mbernhard.com"); !ok || w.Owner != "web" {
+		t.Errorf("Expected the name attributed to the first domain watched, got %v", w)
+	}
+	wl.remove(1)
+	if _, ok := wl.index("pilot").lookup("www.mbernhard.com"); !ok {
+		t.Errorf("Expected a pattern watched twice to stay until both are removed")
+	}
+	if _, ok := wl.index("rocketeer").lookup("www.mbernhard.com"); ok {
+		t.Errorf("Expected the pattern gone from the log only the removed domain was watched in")
+	}
+	if w, ok := wl.watched("pilot", "mbernhard.com"); !ok || w.Owner != "mail" {
+		t.Errorf("Expected the name attributed to the remaining domain, got %v", w)
+	}
+
+	wl.add(watchedDomain{ID: 2, Domain: "imsg.com", Type: "wildcard", CTServer: "pilot"})
+	if _, ok := wl.index("pilot").lookup("www.mbernhard.com"); ok {
+		t.Errorf("Expected an updated domain to stop matching its old pattern")
+	}
+	if _, ok := wl.index("pilot").lookup("a.imsg.com"); !ok {
+		t.Errorf("Expected an updated domain to match its new pattern")
+	}
+	if hit, ok := wl.index("pilot").lookalikeCert(&x509.Certificate{DNSNames: []string{"mbernhart.com"}}); ok {
+		t.Errorf("Expected no look-alikes of a domain no longer watched, got %v", hit)
+	}
+	if _, ok := before.lookup("www.mbernhard.com"); !ok || before.len() != 1 {
+		t.Errorf("Expected an index already handed out to be left as it was")
+	}
+}
+
+func TestWatchlistUpdateInPlace(t *testing.T) {
+	web := watchedDomain{ID: 1, Domain: "mbernhard.com", Type: "suffix", Owner: "web"}
+	mail := watchedDomain{ID: 2, Domain: "mbernhard.com", Type: "suffix", Owner: "mail", CTServer: "pilot"}
+	updated := web
+	updated.Issuers = []string{"Let's Encrypt"}
+
+	wl := newWatchlist([]string{"pilot", "rocketeer"})
+	wl.add(web)
+	wl.add(mail)
+	wl.add(updated)
+	refreshed := newWatchlist([]string{"pilot", "rocketeer"})
+	refreshed.replace([]watchedDomain{updated, mail})
+
+	for _, server := range []string{"pilot", "rocketeer"} {
+		w, ok := wl.watched(server, "mbernhard.com")
+		expected, _ := refreshed.watched(server, "mbernhard.com")
+		if !ok || w.ID != expected.ID || w.Owner != "web" || len(w.Issuers) != 1 {
+			t.Errorf("%s: expected an update to keep the name attributed as a refresh does, got %v, not %v",
+				server, w, expected)
+		}
+	}
+}
+
+// Run with -race: domains are added and removed through the API while
+// scanner workers match certificates against the same log
+func TestWatchlistConcurrentUpdates(t *testing.T) {
+	var m Monitor
+	m.Initialize(os.Getenv("TEST_DB_USERNAME"), os.Getenv("TEST_DB_PASSWORD"), os.Getenv("TEST_DB_NAME"))
+	defer m.DB.Close()
+	clear := func() { m.DB.Exec("DELETE FROM watched_domains WHERE log_name = 'pilot'") }
+	clear()
+	defer clear()
+	saved := hostnames
+	hostnames = newWatchlist([]string{"pilot"})
+	defer func() { hostnames = saved }()
+
+	executeRequest := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		m.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	matcher := orMatcher{hostnameMatcher{"pilot"}, lookalikeMatcher{"pilot"}}
+	cert := &x509.Certificate{DNSNames: []string{"www.domain99.com"}}
+
+	var writers, readers sync.WaitGroup
+	stop := make(chan bool)
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					matcher.Match(cert)
+					hostnames.index("pilot").matchCert(cert)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			for j := i; j < 100; j += 4 {
+				body := `{"domain": "domain` + strconv.Itoa(j) + `.com", "server": "pilot"}`
+				response := executeRequest("POST", "/watchlist", body)
+				if response.Code != http.StatusCreated {
+					t.Errorf("Couldn't add domain%d.com: %d %s", j, response.Code, response.Body)
+					continue
+				}
+				// Stop watching every other domain again
+				if j%2 == 0 {
+					var w watchedDomain
+					json.Unmarshal(response.Body.Bytes(), &w)
+					path := "/watchlist/" + strconv.FormatInt(w.ID, 10)
+					if response = executeRequest("DELETE", path, ""); response.Code != http.StatusOK {
+						t.Errorf("Couldn't remove domain%d.com: %d %s", j, response.Code, response.Body)
+					}
+				}
+			}
+		}(i)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	if n := hostnames.index("pilot").len(); n != 50 {
+		t.Errorf("Expected 50 watched domains, got %d", n)
+	}
+	if !matcher.Match(cert) {
+		t.Errorf("Expected the certificate to match once its domain is watched")
+	}
+	if _, _, ok := hostnames.index("pilot").matchCert(&x509.Certificate{DNSNames: []string{"www.domain98.com"}}); ok {
+		t.Errorf("Expected a domain removed again not to match")
+	}
+}